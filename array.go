@@ -0,0 +1,263 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	"reflect"
+	"strings"
+)
+
+// arrayValue is a value of an array type, of any element type. Its elements
+// are encoded and decoded by the implementation of the element type.
+type arrayValue struct {
+	elemOID    pgtype.OID
+	elem       pgtype.Value // the registered value of the element type
+	elements   []pgtype.Value
+	dimensions []pgtype.ArrayDimension
+	status     pgtype.Status
+}
+
+func (dst *arrayValue) Set(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		dst.elements, dst.dimensions, dst.status = nil, nil, pgtype.Null
+		return nil
+	case string:
+		return dst.DecodeText(nil, []byte(value))
+	case []byte:
+		return dst.DecodeText(nil, value)
+	}
+
+	// one dimensional slices of any of the values the elements can be set to
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Errorf("cannot convert %v to array", src)
+	}
+
+	elements := make([]pgtype.Value, v.Len())
+	for i := range elements {
+		elements[i] = cloneValue(dst.elem)
+		if err := elements[i].Set(v.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+
+	dst.elements, dst.dimensions, dst.status = elements, nil, pgtype.Present
+	if len(elements) > 0 {
+		dst.dimensions = []pgtype.ArrayDimension{{Length: int32(len(elements)), LowerBound: 1}}
+	}
+	return nil
+}
+
+func (dst *arrayValue) Get() interface{} {
+	switch dst.status {
+	case pgtype.Present:
+		values := make([]interface{}, len(dst.elements))
+		for i, e := range dst.elements {
+			values[i] = e.Get()
+		}
+		return values
+	case pgtype.Null:
+		return nil
+	default:
+		return dst.status
+	}
+}
+
+func (src *arrayValue) AssignTo(dst interface{}) error {
+	v, ok := dst.(*[]interface{})
+	if !ok || src.status != pgtype.Present {
+		return fmt.Errorf("cannot assign %v to %T", src, dst)
+	}
+	*v = src.Get().([]interface{})
+	return nil
+}
+
+func (dst *arrayValue) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		return dst.Set(nil)
+	}
+
+	uta, err := pgtype.ParseUntypedTextArray(string(src))
+	if err != nil {
+		return err
+	}
+
+	elements := make([]pgtype.Value, len(uta.Elements))
+	for i, s := range uta.Elements {
+		elements[i] = cloneValue(dst.elem)
+		decoder, ok := elements[i].(pgtype.TextDecoder)
+		if !ok {
+			return fmt.Errorf("cannot decode elements of type %T", dst.elem)
+		}
+
+		var elemSrc []byte
+		if s != "NULL" {
+			elemSrc = []byte(s)
+		}
+		if err := decoder.DecodeText(ci, elemSrc); err != nil {
+			return err
+		}
+	}
+
+	dst.elements, dst.dimensions, dst.status = elements, uta.Dimensions, pgtype.Present
+	return nil
+}
+
+func (dst *arrayValue) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		return dst.Set(nil)
+	}
+
+	var header pgtype.ArrayHeader
+	rp, err := header.DecodeBinary(ci, src)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	if len(header.Dimensions) > 0 {
+		count = 1
+		for _, d := range header.Dimensions {
+			count *= int(d.Length)
+		}
+	}
+
+	elements := make([]pgtype.Value, count)
+	for i := range elements {
+		elements[i] = cloneValue(dst.elem)
+		decoder, ok := elements[i].(pgtype.BinaryDecoder)
+		if !ok {
+			return fmt.Errorf("cannot decode elements of type %T", dst.elem)
+		}
+
+		if len(src[rp:]) < 4 {
+			return fmt.Errorf("array element %d is missing", i)
+		}
+		length := int32(binary.BigEndian.Uint32(src[rp:]))
+		rp += 4
+
+		var elemSrc []byte
+		if length >= 0 {
+			if len(src[rp:]) < int(length) {
+				return fmt.Errorf("array element %d is too short", i)
+			}
+			elemSrc = src[rp : rp+int(length)]
+			rp += int(length)
+		}
+		if err := decoder.DecodeBinary(ci, elemSrc); err != nil {
+			return err
+		}
+	}
+
+	dst.elements, dst.dimensions, dst.status = elements, header.Dimensions, pgtype.Present
+	return nil
+}
+
+func (src *arrayValue) EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+
+	if len(src.elements) == 0 {
+		return append(buf, "{}"...), nil
+	}
+
+	buf = pgtype.EncodeTextArrayDimensions(buf, src.dimensions)
+	return src.appendText(ci, buf, src.dimensions, src.elements)
+}
+
+// appendText appends the elements of the provided dimensions in text format,
+// as nested lists of elements, like {{1,2},{3,NULL}}
+func (src *arrayValue) appendText(ci *pgtype.ConnInfo, buf []byte, dims []pgtype.ArrayDimension, elements []pgtype.Value) ([]byte, error) {
+	buf = append(buf, '{')
+	size := len(elements) / int(dims[0].Length)
+	for i := 0; i < int(dims[0].Length); i++ {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		if len(dims) > 1 {
+			var err error
+			buf, err = src.appendText(ci, buf, dims[1:], elements[i*size:(i+1)*size])
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		text, err := formatText(ci, elements[i])
+		if err != nil {
+			return nil, err
+		}
+		if text == nil {
+			buf = append(buf, "NULL"...)
+		} else {
+			buf = append(buf, quoteArrayElement(string(text))...)
+		}
+	}
+	return append(buf, '}'), nil
+}
+
+func (src *arrayValue) EncodeBinary(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+
+	header := pgtype.ArrayHeader{ElementOID: int32(src.elemOID), Dimensions: src.dimensions}
+	for _, e := range src.elements {
+		if e.Get() == nil {
+			header.ContainsNull = true
+		}
+	}
+	buf = header.EncodeBinary(ci, buf)
+
+	for _, e := range src.elements {
+		encoder, ok := e.(pgtype.BinaryEncoder)
+		if !ok {
+			return nil, fmt.Errorf("cannot encode elements of type %T", e)
+		}
+
+		sp := len(buf)
+		buf = append(buf, 0, 0, 0, 0)
+		elemBuf, err := encoder.EncodeBinary(ci, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if e.Get() == nil {
+			binary.BigEndian.PutUint32(buf[sp:], 0xFFFFFFFF)
+			continue
+		}
+		buf = elemBuf
+		binary.BigEndian.PutUint32(buf[sp:], uint32(len(buf)-sp-4))
+	}
+	return buf, nil
+}
+
+// Value implements the database/sql/driver Valuer interface, with the text
+// format of the array
+func (src *arrayValue) Value() (driver.Value, error) {
+	buf, err := src.EncodeText(nil, nil)
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return string(buf), nil
+}
+
+// quoteArrayElement quotes an element of an array in text format, when it's
+// required for it to be read back, just like Postgres does
+func quoteArrayElement(s string) string {
+	if s != "" && !strings.EqualFold(s, "NULL") && !strings.ContainsAny(s, "{},\"\\ \t\n\r\v\f") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,55 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgtype"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestArrayValue(t *testing.T) {
+	ci := newConnInfo()
+
+	t.Run("text format", func(t *testing.T) {
+		for _, tt := range []struct {
+			oid      pgtype.OID
+			value    interface{}
+			expected string
+		}{
+			{pgtype.Int4ArrayOID, []int64{1, 2, 3}, "{1,2,3}"},
+			{pgtype.Int4ArrayOID, []interface{}{int64(1), nil}, "{1,NULL}"},
+			{pgtype.Int4ArrayOID, []int64{}, "{}"},
+			{pgtype.TextArrayOID, []string{"a", "b c", "", "null", `"q"`}, `{a,"b c","","null","\"q\""}`},
+			{pgtype.Float8ArrayOID, []float64{1.5, 1e20}, "{1.5,1e+20}"},
+			{1187, []time.Duration{time.Hour}, `{01:00:00}`},
+			{pgtype.UUIDArrayOID, "{a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11}", "{a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11}"},
+			{pgtype.Int4ArrayOID, "{{1,2},{3,4}}", "{{1,2},{3,4}}"},
+			{pgtype.Int4ArrayOID, "[0:1]={1,2}", "[0:1]={1,2}"},
+		} {
+			buf, err := encodeText(ci, tt.oid, tt.value)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, string(buf))
+		}
+	})
+	t.Run("binary format", func(t *testing.T) {
+		buf, err := encodeBinary(ci, pgtype.Int4ArrayOID, []interface{}{int64(1), nil})
+		require.NoError(t, err)
+		require.Equal(t, []byte{
+			0, 0, 0, 1, // dimensions
+			0, 0, 0, 1, // contains null
+			0, 0, 0, 23, // element type
+			0, 0, 0, 2, 0, 0, 0, 1, // length and lower bound
+			0, 0, 0, 4, 0, 0, 0, 1, // 1
+			255, 255, 255, 255, // NULL
+		}, buf)
+
+		v := newValue(dataTypeForOID(ci, pgtype.Int4ArrayOID))
+		require.NoError(t, v.(pgtype.BinaryDecoder).DecodeBinary(ci, buf))
+		require.Equal(t, []interface{}{int32(1), nil}, v.Get())
+	})
+	t.Run("decodes text", func(t *testing.T) {
+		v := newValue(dataTypeForOID(ci, pgtype.TextArrayOID))
+		require.NoError(t, v.(pgtype.TextDecoder).DecodeText(ci, []byte(`{a,"b,c"}`)))
+		require.Equal(t, []interface{}{"a", "b,c"}, v.Get())
+	})
+}
@@ -9,25 +9,27 @@ import (
 )
 
 const errExpectedPassword = "expected password response, got message type %q"
-const errWrongPassword = "password does not match for user \"%s\""
 
-// authenticator interface defines objects able to perform user authentication
-// that happens at the very beginning of every session.
-type authenticator interface {
-	// authenticate accepts a protocol.MessageReadWriter instance and a map of args that describe
-	// the current session. It returns no error if the authentication succeeds,
-	// or an error if something fails.
-	//
-	// Authentication errors as well as welcome messages are sent by this function,
-	// so there is no need for the caller to send these. It is caller's responsibility
-	// though to terminate the session in case that an error is returned.
-	authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error
+// NewPasswordAuthenticator creates an Authenticator that requests and verifies
+// the passwords of the users, in the way of the provider's auth type. The
+// passwords are provided by pp (see PasswordProvider).
+func NewPasswordAuthenticator(pp PasswordProvider) Authenticator {
+	switch pp.Type() {
+	case MD5:
+		return &md5Authenticator{pp}
+	case Plain:
+		return &clearTextAuthenticator{pp}
+	case SCRAMSHA256:
+		return newSCRAMAuthenticator(pp)
+	default:
+		return &noPasswordAuthenticator{}
+	}
 }
 
 // noPasswordAuthenticator responds with auth OK immediately.
 type noPasswordAuthenticator struct{}
 
-func (np *noPasswordAuthenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
+func (np *noPasswordAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
 	return rw.Write(authOKMsg())
 }
 
@@ -43,14 +45,100 @@ const (
 
 	// Plain is an auth type where password is sent as plain text over network
 	Plain AuthType = "plain"
+
+	// SCRAMSHA256 is an auth type where the client proves it knows the password
+	// by the SCRAM-SHA-256 SASL mechanism. Passwords are stored as SCRAM
+	// verifiers (see SCRAMVerifier).
+	SCRAMSHA256 AuthType = "scram-sha-256"
 )
 
 // PasswordProvider describes objects that are able to provide a password given a user name.
+// The format of the password depends on the auth type: MD5 passwords are hashed
+// as md5(concat(password, user)), and SCRAMSHA256 passwords are SCRAM verifiers.
 type PasswordProvider interface {
 	Type() AuthType
 	GetPassword(user string) ([]byte, error)
 }
 
+// Credentials are the authentication method of a user, along with the secret
+// it's verified by. The secret is in the format of the PasswordProvider of the
+// same type, and empty for Trust.
+type Credentials struct {
+	Type   AuthType
+	Secret []byte
+}
+
+// CredentialsProvider describes objects that are able to provide the
+// credentials of each user, which allows for different authentication methods
+// per user. It returns an error for unknown users.
+//
+// Providers may also implement the Type method of PasswordProvider, to report
+// the default authentication method of the users, which is SCRAMSHA256
+// otherwise.
+type CredentialsProvider interface {
+	GetCredentials(user string) (Credentials, error)
+}
+
+// NewCredentialsAuthenticator creates an Authenticator that authenticates each
+// user by the method of its credentials, provided by cp. Unknown users, and
+// errors of the provider, go through the exchange of the default method (see
+// CredentialsProvider), which fails just like a wrong password does, so that
+// they can't be told apart from existing users.
+func NewCredentialsAuthenticator(cp CredentialsProvider) Authenticator {
+	a := &credentialsAuthenticator{cp: cp, defaultType: SCRAMSHA256, mockSecret: randomBytes(32)}
+	if typed, ok := cp.(interface{ Type() AuthType }); ok {
+		switch typed.Type() {
+		case MD5, Plain, SCRAMSHA256:
+			a.defaultType = typed.Type()
+		}
+	}
+	return a
+}
+
+// credentialsAuthenticator authenticates each user by the method of its
+// credentials
+type credentialsAuthenticator struct {
+	cp          CredentialsProvider
+	defaultType AuthType // the method of unknown users
+	mockSecret  []byte   // derives the salts of the SCRAM mock verifiers of unknown users
+}
+
+func (a *credentialsAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
+	user, _ := client.Args["user"].(string)
+	creds, err := a.cp.GetCredentials(user)
+	if err != nil {
+		creds = Credentials{Type: a.defaultType}
+	}
+
+	pp := &credentialsPasswordProvider{creds: creds, err: err}
+	switch creds.Type {
+	case Trust:
+		return (&noPasswordAuthenticator{}).Authenticate(rw, client)
+	case MD5, Plain:
+		return NewPasswordAuthenticator(pp).Authenticate(rw, client)
+	case SCRAMSHA256:
+		scram := &scramAuthenticator{pp: pp, mockSecret: a.mockSecret}
+		return scram.Authenticate(rw, client)
+	default:
+		return failAuthentication(rw, InvalidPassword(user))
+	}
+}
+
+// credentialsPasswordProvider provides the secret of the credentials of a
+// single user, or the error of looking them up
+type credentialsPasswordProvider struct {
+	creds Credentials
+	err   error
+}
+
+func (pp *credentialsPasswordProvider) Type() AuthType {
+	return pp.creds.Type
+}
+
+func (pp *credentialsPasswordProvider) GetPassword(user string) ([]byte, error) {
+	return pp.creds.Secret, pp.err
+}
+
 // constantPasswordProvider is a password provider that always returns the same password,
 // which it is given during the initialization.
 type constantPasswordProvider struct {
@@ -90,7 +178,7 @@ type clearTextAuthenticator struct {
 	pp PasswordProvider
 }
 
-func (a *clearTextAuthenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
+func (a *clearTextAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
 	// AuthenticationClearText
 	passwordRequest := protocol.Message{
 		'R',
@@ -109,21 +197,20 @@ func (a *clearTextAuthenticator) authenticate(rw protocol.MessageReadWriter, arg
 	}
 
 	if m.Type() != 'p' {
-		err = fmt.Errorf(errExpectedPassword, m.Type())
-		err = WithSeverity(fromErr(err), fatalSeverity)
-		rw.Write(protocol.ErrorResponse(err))
-		return err
+		return failAuthentication(rw, ProtocolViolation(fmt.Sprintf(errExpectedPassword, m.Type())))
 	}
 
-	user := args["user"].(string)
+	actualPassword, err := extractPassword(m)
+	if err != nil {
+		return failAuthentication(rw, err)
+	}
+
+	// unknown users and errors of the provider fail just like wrong passwords
+	user, _ := client.Args["user"].(string)
 	expectedPassword, err := a.pp.GetPassword(user)
-	actualPassword := extractPassword(m)
 
-	if !bytes.Equal(expectedPassword, actualPassword) {
-		err = fmt.Errorf(errWrongPassword, user)
-		err = WithSeverity(fromErr(err), fatalSeverity)
-		rw.Write(protocol.ErrorResponse(err))
-		return err
+	if err != nil || len(expectedPassword) == 0 || !bytes.Equal(expectedPassword, actualPassword) {
+		return failAuthentication(rw, InvalidPassword(user))
 	}
 
 	return rw.Write(authOKMsg())
@@ -136,7 +223,7 @@ type md5Authenticator struct {
 	pp PasswordProvider
 }
 
-func (a *md5Authenticator) authenticate(rw protocol.MessageReadWriter, args map[string]interface{}) error {
+func (a *md5Authenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
 	// AuthenticationMD5Password
 	passwordRequest := protocol.Message{
 		'R',
@@ -157,31 +244,37 @@ func (a *md5Authenticator) authenticate(rw protocol.MessageReadWriter, args map[
 	}
 
 	if m.Type() != 'p' {
-		err = fmt.Errorf(errExpectedPassword, m.Type())
-		err = WithSeverity(fromErr(err), fatalSeverity)
-		rw.Write(protocol.ErrorResponse(err))
-		return err
+		return failAuthentication(rw, ProtocolViolation(fmt.Sprintf(errExpectedPassword, m.Type())))
 	}
 
-	user := args["user"].(string)
+	actualHash, err := extractPassword(m)
+	if err != nil {
+		return failAuthentication(rw, err)
+	}
+
+	// unknown users and errors of the provider fail just like wrong passwords
+	user, _ := client.Args["user"].(string)
 	storedHash, err := a.pp.GetPassword(user)
 	expectedHash := hashWithSalt(storedHash, salt)
 
-	actualHash := extractPassword(m)
-
-	if !bytes.Equal(expectedHash, actualHash) {
-		err = fmt.Errorf(errWrongPassword, user)
-		err = WithSeverity(fromErr(err), fatalSeverity)
-		rw.Write(protocol.ErrorResponse(err))
-		return err
+	if err != nil || len(storedHash) == 0 || !bytes.Equal(expectedHash, actualHash) {
+		return failAuthentication(rw, InvalidPassword(user))
 	}
 
 	return rw.Write(authOKMsg())
 }
 
+// failAuthentication notifies the frontend of the error as FATAL, and returns
+// it, which terminates the session
+func failAuthentication(rw protocol.MessageReadWriter, err error) error {
+	err = WithSeverity(fromErr(err), fatalSeverity)
+	rw.Write(protocol.ErrorResponse(err))
+	return err
+}
+
 // authOKMsg returns a message that indicates that the client is now authenticated.
 func authOKMsg() protocol.Message {
-	return []byte{'R', 0, 0, 0, 8, 0, 0, 0, 0}
+	return protocol.AuthenticationOk
 }
 
 // getRandomSalt returns a cryptographically secure random slice of 4 bytes.
@@ -191,11 +284,15 @@ func getRandomSalt() []byte {
 	return salt
 }
 
-// extractPassword extracts the password from a provided 'p' message.
-// It assumes that the message is valid.
-func extractPassword(m protocol.Message) []byte {
+// extractPassword extracts the password from a provided 'p' message. Messages
+// without a null-terminated password are rejected as protocol violations.
+func extractPassword(m protocol.Message) ([]byte, error) {
+	if len(m) < 6 || m[len(m)-1] != 0 {
+		return nil, ProtocolViolation("invalid password packet size")
+	}
+
 	// password starts after the size (4 bytes) and lasts until null-terminator
-	return m[5 : len(m)-1]
+	return m[5 : len(m)-1], nil
 }
 
 // hashWithSalt salts the provided md5 hash and hashes the result using md5.
@@ -3,6 +3,8 @@ package pgsrv
 import (
 	"bytes"
 	"crypto/md5"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
 	"github.com/panoplyio/pgsrv/protocol"
 	"github.com/stretchr/testify/require"
 	"testing"
@@ -20,20 +22,20 @@ func TestAuthOKMsg(t *testing.T) {
 	require.Equal(t, expectedResult, actualResult)
 }
 
-func TestNoPassword_authenticate(t *testing.T) {
+func TestNoPassword_Authenticate(t *testing.T) {
 	rw := &mockMessageReadWriter{output: []protocol.Message{}}
 	args := map[string]interface{}{
 		"user": "this-is-user",
 	}
 
 	np := &noPasswordAuthenticator{}
-	err := np.authenticate(rw, args)
+	err := np.Authenticate(rw, &Client{Args: args})
 
 	require.NoError(t, err)
 	require.Equal(t, []protocol.Message{authOKMessage}, rw.messages)
 }
 
-func TestAuthenticationClearText_authenticate(t *testing.T) {
+func TestAuthenticationClearText_Authenticate(t *testing.T) {
 	passwordRequest := protocol.Message{
 		'R',
 		0, 0, 0, 8, // length
@@ -54,7 +56,7 @@ func TestAuthenticationClearText_authenticate(t *testing.T) {
 
 	t.Run("valid password", func(t *testing.T) {
 		defer rw.Reset()
-		err := a.authenticate(rw, args)
+		err := a.Authenticate(rw, &Client{Args: args})
 
 		require.NoError(t, err)
 		expectedMessages := []protocol.Message{
@@ -67,11 +69,22 @@ func TestAuthenticationClearText_authenticate(t *testing.T) {
 	t.Run("invalid password", func(t *testing.T) {
 		defer rw.Reset()
 		pp.password = []byte("shtoot")
-		err := a.authenticate(rw, args)
+		err := a.Authenticate(rw, &Client{Args: args})
 
 		require.Equal(t, passwordRequest, rw.messages[0])
 		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
-		require.EqualError(t, err, "password does not match for user \"this-is-user\"")
+		require.EqualError(t, err, "password authentication failed for user \"this-is-user\"")
+		require.Equal(t, "28P01", fromErr(err).Code())
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		defer rw.Reset()
+		rw := &mockMessageReadWriter{output: []protocol.Message{{'p', 0, 0, 0, 5, 0}}}
+		a := &clearTextAuthenticator{&failingPasswordProvider{Plain}}
+		err := a.Authenticate(rw, &Client{Args: args})
+
+		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
+		require.EqualError(t, err, "password authentication failed for user \"this-is-user\"")
 	})
 
 	t.Run("invalid message type", func(t *testing.T) {
@@ -79,15 +92,24 @@ func TestAuthenticationClearText_authenticate(t *testing.T) {
 		rw = &mockMessageReadWriter{output: []protocol.Message{
 			{'q', 0, 0, 0, 5, 1},
 		}}
-		err := a.authenticate(rw, args)
+		err := a.Authenticate(rw, &Client{Args: args})
 
 		require.Equal(t, passwordRequest, rw.messages[0])
 		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
 		require.EqualError(t, err, "expected password response, got message type 'q'")
 	})
+
+	t.Run("malformed password message", func(t *testing.T) {
+		rw := &mockMessageReadWriter{output: []protocol.Message{{'p', 0, 0, 0, 4}}}
+		err := a.Authenticate(rw, &Client{Args: args})
+
+		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
+		require.EqualError(t, err, "invalid password packet size")
+		require.Equal(t, "08P01", fromErr(err).Code())
+	})
 }
 
-func TestAuthenticationMD5_authenticate(t *testing.T) {
+func TestAuthenticationMD5_Authenticate(t *testing.T) {
 	passwordRequest := protocol.Message{
 		'R',
 		0, 0, 0, 12, // length
@@ -107,7 +129,7 @@ func TestAuthenticationMD5_authenticate(t *testing.T) {
 
 	t.Run("valid password", func(t *testing.T) {
 		defer rw.Reset()
-		err := a.authenticate(rw, args)
+		err := a.Authenticate(rw, &Client{Args: args})
 
 		require.NoError(t, err)
 		require.True(t, bytes.Contains(rw.messages[0], passwordRequest))
@@ -117,11 +139,33 @@ func TestAuthenticationMD5_authenticate(t *testing.T) {
 	t.Run("invalid password", func(t *testing.T) {
 		defer rw.Read()
 		pp.password = []byte("shtoot")
-		err := a.authenticate(rw, args)
+		err := a.Authenticate(rw, &Client{Args: args})
 
 		require.True(t, bytes.Contains(rw.messages[0], passwordRequest))
 		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
-		require.EqualError(t, err, "password does not match for user \"postgres\"")
+		require.EqualError(t, err, "password authentication failed for user \"postgres\"")
+		require.Equal(t, "28P01", fromErr(err).Code())
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		// the password of users that have none is md5 hashed as empty
+		rw := &mockMD5MessageReadWriter{user: "postgres", salt: []byte{}}
+		rw.hash = []byte{}
+		a := &md5Authenticator{&failingPasswordProvider{MD5}}
+		err := a.Authenticate(rw, &Client{Args: args})
+
+		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
+		require.EqualError(t, err, "password authentication failed for user \"postgres\"")
+	})
+
+	t.Run("missing user", func(t *testing.T) {
+		rw := &mockMD5MessageReadWriter{salt: []byte{}}
+		a := &md5Authenticator{&failingPasswordProvider{MD5}}
+		var err error
+		require.NotPanics(t, func() {
+			err = a.Authenticate(rw, &Client{Args: map[string]interface{}{}})
+		})
+		require.EqualError(t, err, "password authentication failed for user \"\"")
 	})
 
 	t.Run("invalid message type", func(t *testing.T) {
@@ -129,7 +173,7 @@ func TestAuthenticationMD5_authenticate(t *testing.T) {
 		rw := &mockMessageReadWriter{output: []protocol.Message{
 			{'q', 0, 0, 0, 5, 1},
 		}}
-		err := a.authenticate(rw, args)
+		err := a.Authenticate(rw, &Client{Args: args})
 
 		require.True(t, bytes.Contains(rw.messages[0], passwordRequest))
 		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
@@ -175,7 +219,8 @@ func TestExtractPassword(t *testing.T) {
 		}
 
 		expectedResult := []byte{42, 42, 42, 42}
-		actualResult := extractPassword(passwordMessage)
+		actualResult, err := extractPassword(passwordMessage)
+		require.NoError(t, err)
 		require.Equal(t, expectedResult, actualResult)
 	})
 
@@ -187,9 +232,21 @@ func TestExtractPassword(t *testing.T) {
 		}
 
 		expectedResult := []byte{}
-		actualResult := extractPassword(passwordMessage)
+		actualResult, err := extractPassword(passwordMessage)
+		require.NoError(t, err)
 		require.Equal(t, expectedResult, actualResult)
 	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, m := range []protocol.Message{
+			{'p', 0, 0, 0, 4},
+			{'p', 0, 0, 0, 9, 42, 42, 42, 42},
+		} {
+			_, err := extractPassword(m)
+			require.Error(t, err)
+			require.Equal(t, "08P01", fromErr(err).Code())
+		}
+	})
 }
 
 // mockMessageReadWriter implements messageReadWriter and outputs the provided output
@@ -218,6 +275,7 @@ func (rw *mockMessageReadWriter) Reset() {
 type mockMD5MessageReadWriter struct {
 	user     string
 	pass     []byte
+	hash     []byte // overrides the md5 hash of the password, when set
 	salt     []byte
 	messages []protocol.Message
 }
@@ -228,6 +286,10 @@ func (rw *mockMD5MessageReadWriter) Read() (protocol.Message, error) {
 		0, 0, 0, 25,
 	}
 	hash := md5.Sum(append(rw.pass, []byte(rw.user)...))
+	if rw.hash != nil {
+		message = append(message, hashWithSalt(rw.hash, rw.salt)...)
+		return append(message, 0), nil
+	}
 	message = append(message, hashWithSalt(hash[:], rw.salt)...)
 	message = append(message, 0)
 	return message, nil
@@ -242,3 +304,144 @@ func (rw *mockMD5MessageReadWriter) Write(m protocol.Message) error {
 func (rw *mockMD5MessageReadWriter) Reset() {
 	rw.messages = make([]protocol.Message, 0)
 }
+
+func TestNewPasswordAuthenticator(t *testing.T) {
+	require.IsType(t, &clearTextAuthenticator{}, NewPasswordAuthenticator(&constantPasswordProvider{}))
+	require.IsType(t, &md5Authenticator{}, NewPasswordAuthenticator(&md5ConstantPasswordProvider{}))
+	require.IsType(t, &scramAuthenticator{}, NewPasswordAuthenticator(&scramPasswordProvider{}))
+}
+
+func TestSession_startUp_authenticator(t *testing.T) {
+	f, b := loopbackPipe(t)
+	defer f.Close()
+
+	a := &mockAuthenticator{}
+	srv := New(&mockQueryer{}, WithAuthenticator(a)).(*server)
+	errs := make(chan error, 1)
+	go func() {
+		s := &session{Server: srv, Conn: b}
+		errs <- s.startUp()
+	}()
+
+	_, err := f.Write((&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres", "database": "db"},
+	}).Encode(nil))
+	require.NoError(t, err)
+
+	frontend, err := pgproto3.NewFrontend(f, nil)
+	require.NoError(t, err)
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	require.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+	require.Error(t, <-errs)
+
+	require.Equal(t, f.LocalAddr().String(), a.client.RemoteAddr.String())
+	require.Nil(t, a.client.TLS)
+	require.Equal(t, map[string]interface{}{"user": "postgres", "database": "db"}, a.client.Args)
+}
+
+// mockAuthenticator records the client it authenticates, and rejects it
+type mockAuthenticator struct {
+	client *Client
+}
+
+func (a *mockAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
+	a.client = client
+	err := InvalidAuthorizationSpecification("rejected")
+	rw.Write(protocol.ErrorResponse(err))
+	return err
+}
+
+// failingPasswordProvider fails to provide passwords, like it does for unknown
+// users
+type failingPasswordProvider struct {
+	authType AuthType
+}
+
+func (pp *failingPasswordProvider) Type() AuthType {
+	return pp.authType
+}
+
+func (pp *failingPasswordProvider) GetPassword(user string) ([]byte, error) {
+	return nil, fmt.Errorf("unknown user %s", user)
+}
+
+func TestCredentialsAuthenticator_Authenticate(t *testing.T) {
+	a := NewCredentialsAuthenticator(mockCredentialsProvider{
+		"trusted": {Type: Trust},
+		"md5":     {Type: MD5, Secret: md5Hash("testmd5")},
+		"scram":   {Type: SCRAMSHA256, Secret: SCRAMVerifier("test")},
+		"unknown": {Type: "foo"},
+	})
+	client := func(user string) *Client {
+		return &Client{Args: map[string]interface{}{"user": user}}
+	}
+
+	t.Run("trust", func(t *testing.T) {
+		rw := &mockMessageReadWriter{}
+		require.NoError(t, a.Authenticate(rw, client("trusted")))
+		require.Equal(t, []protocol.Message{authOKMessage}, rw.messages)
+	})
+	t.Run("md5", func(t *testing.T) {
+		rw := &mockMD5MessageReadWriter{user: "md5", pass: []byte("test")}
+		require.NoError(t, a.Authenticate(rw, client("md5")))
+		require.Equal(t, authOKMessage, rw.messages[1])
+
+		rw = &mockMD5MessageReadWriter{user: "md5", pass: []byte("shtoot")}
+		err := a.Authenticate(rw, client("md5"))
+		require.EqualError(t, err, "password authentication failed for user \"md5\"")
+	})
+	t.Run("scram", func(t *testing.T) {
+		rw := &mockSCRAMMessageReadWriter{pass: "test", gs2Header: "n,,"}
+		require.NoError(t, a.Authenticate(rw, client("scram")))
+		require.Equal(t, authSASLMsg("SCRAM-SHA-256"), rw.messages[0])
+	})
+	t.Run("unknown user", func(t *testing.T) {
+		rw := &mockSCRAMMessageReadWriter{pass: "test", gs2Header: "n,,"}
+		err := a.Authenticate(rw, client("nobody"))
+		require.Equal(t, authSASLMsg("SCRAM-SHA-256"), rw.messages[0], "expected unknown users to be asked for a password")
+		require.EqualError(t, err, "password authentication failed for user \"nobody\"")
+		require.Equal(t, "28P01", fromErr(err).Code())
+	})
+	t.Run("unknown user of the default type", func(t *testing.T) {
+		a := NewCredentialsAuthenticator(md5CredentialsProvider{})
+		rw := &mockMD5MessageReadWriter{user: "nobody", pass: []byte("test")}
+		err := a.Authenticate(rw, client("nobody"))
+		require.Equal(t, protocol.Message{'R', 0, 0, 0, 12, 0, 0, 0, 5}, rw.messages[0][:9], "expected an md5 challenge")
+		require.Equal(t, "28P01", fromErr(err).Code())
+	})
+	t.Run("unknown type", func(t *testing.T) {
+		rw := &mockMessageReadWriter{}
+		err := a.Authenticate(rw, client("unknown"))
+		require.EqualError(t, err, "password authentication failed for user \"unknown\"")
+		require.True(t, bytes.Contains(rw.messages[0], fatalMarker))
+	})
+}
+
+func md5Hash(s string) []byte {
+	hash := md5.Sum([]byte(s))
+	return hash[:]
+}
+
+// mockCredentialsProvider provides the credentials of the users by their names
+type mockCredentialsProvider map[string]Credentials
+
+func (cp mockCredentialsProvider) GetCredentials(user string) (Credentials, error) {
+	creds, ok := cp[user]
+	if !ok {
+		return Credentials{}, fmt.Errorf("unknown user %s", user)
+	}
+	return creds, nil
+}
+
+// md5CredentialsProvider provides no credentials, and reports that users are
+// authenticated by md5 by default
+type md5CredentialsProvider struct {
+	mockCredentialsProvider
+}
+
+func (cp md5CredentialsProvider) Type() AuthType {
+	return MD5
+}
@@ -0,0 +1,320 @@
+package pgsrv
+
+import (
+	"github.com/panoplyio/pgsrv/protocol"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// AuthLimits configures the protection against brute-force attacks on
+// passwords. Failures are counted per user and per source IP address. The
+// responses to failures are delayed exponentially, and users or addresses that
+// fail too many times in a row are locked out for a while. Only wrong
+// passwords count as failures, and a successful authentication resets the
+// failures of its user, but not of its address.
+type AuthLimits struct {
+	// MaxFailures is the number of consecutive failures of a user, or of an
+	// address, after which it's locked out. Zero disables lockouts.
+	MaxFailures int
+
+	// Lockout is how long users and addresses stay locked out. Failures are
+	// forgotten once that long has passed since the last one, or an hour when
+	// there's no lockout.
+	Lockout time.Duration
+
+	// Delay is the delay of the response to the first failure, which doubles
+	// with every consecutive failure, up to MaxDelay. Zero disables delays.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// Observer, when set, is notified of the failures and rejections. It's
+	// called synchronously, by the sessions that are being authenticated.
+	Observer func(AuthEvent)
+}
+
+// AuthEventType is the type of an AuthEvent
+type AuthEventType string
+
+const (
+	// AuthFailed is the event of a failed authentication
+	AuthFailed AuthEventType = "failed"
+
+	// AuthLockedOut is the event of a failure that locked out the user or the
+	// address
+	AuthLockedOut AuthEventType = "locked-out"
+
+	// AuthRejected is the event of an attempt to authenticate a locked out user
+	// or from a locked out address, which is rejected without authentication
+	AuthRejected AuthEventType = "rejected"
+)
+
+// AuthEvent is a failed or rejected authentication, reported to the observer
+// of AuthLimits
+type AuthEvent struct {
+	Type       AuthEventType
+	User       string
+	RemoteAddr net.Addr
+	Failures   int   // consecutive failures of the user or the address, whichever is higher
+	Err        error // the error the client was rejected with
+}
+
+// defaultAuthFailuresTTL is how long failures are remembered when AuthLimits
+// has no lockout duration
+const defaultAuthFailuresTTL = time.Hour
+
+// maxAuthFailures is the number of users, and of addresses, whose failures are
+// remembered. Beyond it, the ones of the oldest failures are forgotten first.
+const maxAuthFailures = 10000
+
+// authFailures are the consecutive failures of a user or an address
+type authFailures struct {
+	count       int
+	last        time.Time // the time of the last failure
+	lockedUntil time.Time
+}
+
+// limitedAuthenticator enforces AuthLimits on the authentications of another
+// Authenticator
+type limitedAuthenticator struct {
+	Authenticator
+	limits AuthLimits
+
+	mu        sync.Mutex
+	users     map[string]*authFailures
+	addrs     map[string]*authFailures
+	lastSweep time.Time
+
+	maxEntries int // the number of users, and of addresses, that are remembered
+	now        func() time.Time
+	sleep      func(time.Duration)
+}
+
+func newLimitedAuthenticator(a Authenticator, limits AuthLimits) *limitedAuthenticator {
+	return &limitedAuthenticator{
+		Authenticator: a,
+		limits:        limits,
+		users:         map[string]*authFailures{},
+		addrs:         map[string]*authFailures{},
+		maxEntries:    maxAuthFailures,
+		now:           time.Now,
+		sleep:         time.Sleep,
+	}
+}
+
+func (a *limitedAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
+	user, _ := client.Args["user"].(string)
+	addr := ""
+	if ip := remoteIP(client.RemoteAddr); ip != nil {
+		addr = ip.String()
+	}
+
+	// the attempt is counted as a failure before it's authenticated, so that
+	// concurrent attempts can't exceed the limits, and it's undone unless the
+	// password turns out to be wrong
+	failures, locking, rejected := a.attempt(user, addr)
+	if rejected {
+		err := failAuthentication(rw, InvalidPassword(user))
+		a.notify(AuthRejected, user, client, failures, err)
+		return err
+	}
+
+	// the response to a failure is delayed, so the failure is only known once
+	// the error is written
+	delayed := &delayedErrorsReadWriter{MessageReadWriter: rw, delay: a.delay(failures), sleep: a.sleep}
+	err := a.Authenticator.Authenticate(delayed, client)
+	if err == nil {
+		a.succeed(user, addr)
+		return nil
+	}
+	if fromErr(err).Code() != "28P01" {
+		a.undo(user, addr)
+		return err
+	}
+
+	eventType := AuthFailed
+	if locking {
+		eventType = AuthLockedOut
+	}
+	a.notify(eventType, user, client, failures, err)
+	return err
+}
+
+// attempt records an attempt of the user from the address as a failure, unless
+// either is locked out, in which case it's rejected. It returns the
+// consecutive failures of either, whichever is higher, and whether the attempt
+// locks either out.
+func (a *limitedAuthenticator) attempt(user, addr string) (count int, locking, rejected bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	a.sweep(now)
+	for _, f := range []*authFailures{a.users[user], a.addrs[addr]} {
+		if f == nil || a.expired(f, now) {
+			continue
+		}
+		if f.count > count {
+			count = f.count
+		}
+		if now.Before(f.lockedUntil) {
+			rejected = true
+		}
+	}
+	if rejected {
+		return
+	}
+
+	count = 0
+	record := func(failures map[string]*authFailures, key string) {
+		f, ok := failures[key]
+		if !ok && len(failures) >= a.maxEntries {
+			a.evict(failures, now)
+		}
+		if !ok || a.expired(f, now) {
+			f = &authFailures{}
+			failures[key] = f
+		}
+
+		f.count++
+		f.last = now
+		if a.limits.MaxFailures > 0 && f.count >= a.limits.MaxFailures {
+			f.lockedUntil = now.Add(a.limits.Lockout)
+			locking = true
+		}
+		if f.count > count {
+			count = f.count
+		}
+	}
+
+	record(a.users, user)
+	if addr != "" {
+		record(a.addrs, addr)
+	}
+	return
+}
+
+// succeed forgets the failures of the user, and undoes the attempt of the
+// address
+func (a *limitedAuthenticator) succeed(user, addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.users, user)
+	a.release(a.addrs, addr)
+}
+
+// undo undoes the attempt of the user from the address, which didn't fail by a
+// wrong password
+func (a *limitedAuthenticator) undo(user, addr string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.release(a.users, user)
+	a.release(a.addrs, addr)
+}
+
+// release removes a single attempt from the failures of the key, along with the
+// lockout it caused, if any
+func (a *limitedAuthenticator) release(failures map[string]*authFailures, key string) {
+	f, ok := failures[key]
+	if !ok {
+		return
+	}
+
+	f.count--
+	if f.count <= 0 {
+		delete(failures, key)
+	} else if f.count < a.limits.MaxFailures {
+		f.lockedUntil = time.Time{}
+	}
+}
+
+// expired determines if the failures are forgotten, as their time to live
+// passed since the last one
+func (a *limitedAuthenticator) expired(f *authFailures, now time.Time) bool {
+	return now.Sub(f.last) >= a.ttl() && !now.Before(f.lockedUntil)
+}
+
+// ttl returns how long failures are remembered since the last one
+func (a *limitedAuthenticator) ttl() time.Duration {
+	if a.limits.Lockout > 0 {
+		return a.limits.Lockout
+	}
+	return defaultAuthFailuresTTL
+}
+
+// sweep removes the expired failures, at most once per their time to live, so
+// that they don't accumulate
+func (a *limitedAuthenticator) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < a.ttl() {
+		return
+	}
+
+	a.lastSweep = now
+	for _, failures := range []map[string]*authFailures{a.users, a.addrs} {
+		for key, f := range failures {
+			if a.expired(f, now) {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// evict makes room for another key in the failures, which are at their
+// capacity, by removing the expired ones, or the one of the oldest failure when
+// none has expired
+func (a *limitedAuthenticator) evict(failures map[string]*authFailures, now time.Time) {
+	var oldest *authFailures
+	oldestKey := ""
+	for key, f := range failures {
+		if a.expired(f, now) {
+			delete(failures, key)
+		} else if oldest == nil || f.last.Before(oldest.last) {
+			oldest, oldestKey = f, key
+		}
+	}
+
+	if len(failures) >= a.maxEntries && oldest != nil {
+		delete(failures, oldestKey)
+	}
+}
+
+// delay returns the delay of the response to the nth consecutive failure
+func (a *limitedAuthenticator) delay(n int) time.Duration {
+	delay := a.limits.Delay
+	for i := 1; i < n && delay > 0 && delay < math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if a.limits.MaxDelay > 0 && delay > a.limits.MaxDelay {
+		delay = a.limits.MaxDelay
+	}
+	return delay
+}
+
+func (a *limitedAuthenticator) notify(eventType AuthEventType, user string, client *Client, failures int, err error) {
+	if a.limits.Observer == nil {
+		return
+	}
+
+	a.limits.Observer(AuthEvent{
+		Type:       eventType,
+		User:       user,
+		RemoteAddr: client.RemoteAddr,
+		Failures:   failures,
+		Err:        err,
+	})
+}
+
+// delayedErrorsReadWriter delays the error responses written to the frontend
+type delayedErrorsReadWriter struct {
+	protocol.MessageReadWriter
+	delay time.Duration
+	sleep func(time.Duration)
+}
+
+func (rw *delayedErrorsReadWriter) Write(m protocol.Message) error {
+	if m.IsError() && rw.delay > 0 {
+		rw.sleep(rw.delay)
+	}
+	return rw.MessageReadWriter.Write(m)
+}
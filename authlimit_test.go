@@ -0,0 +1,228 @@
+package pgsrv
+
+import (
+	"bytes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimitedAuthenticator_Authenticate(t *testing.T) {
+	var events []AuthEvent
+	var slept []time.Duration
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newAuthenticator := func(limits AuthLimits) *limitedAuthenticator {
+		events, slept = nil, nil
+		limits.Observer = func(e AuthEvent) { events = append(events, e) }
+		a := newLimitedAuthenticator(&clearTextAuthenticator{&constantPasswordProvider{password: []byte("secret")}}, limits)
+		a.now = func() time.Time { return now }
+		a.sleep = func(d time.Duration) { slept = append(slept, d) }
+		return a
+	}
+	authenticate := func(a Authenticator, user, ip, password string) (*mockMessageReadWriter, error) {
+		rw := &mockMessageReadWriter{output: []protocol.Message{passwordMsg(password)}}
+		client := &Client{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 5432},
+			Args:       map[string]interface{}{"user": user},
+		}
+		return rw, a.Authenticate(rw, client)
+	}
+	limits := AuthLimits{MaxFailures: 3, Lockout: time.Minute, Delay: time.Second, MaxDelay: 3 * time.Second}
+
+	t.Run("success", func(t *testing.T) {
+		a := newAuthenticator(limits)
+		rw, err := authenticate(a, "postgres", "1.2.3.4", "secret")
+		require.NoError(t, err)
+		require.Equal(t, authOKMessage, rw.messages[len(rw.messages)-1])
+		require.Empty(t, slept)
+		require.Empty(t, events)
+	})
+
+	t.Run("delays failures exponentially", func(t *testing.T) {
+		a := newAuthenticator(AuthLimits{Delay: time.Second, MaxDelay: 3 * time.Second})
+		for i := 0; i < 4; i++ {
+			_, err := authenticate(a, "postgres", "1.2.3.4", "wrong")
+			require.Error(t, err)
+			require.Equal(t, "28P01", fromErr(err).Code())
+		}
+		require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}, slept)
+		require.Len(t, events, 4)
+		for i, e := range events {
+			require.Equal(t, AuthFailed, e.Type)
+			require.Equal(t, "postgres", e.User)
+			require.Equal(t, "1.2.3.4:5432", e.RemoteAddr.String())
+			require.Equal(t, i+1, e.Failures)
+		}
+	})
+
+	t.Run("locks out users", func(t *testing.T) {
+		a := newAuthenticator(limits)
+		for i := 0; i < 3; i++ {
+			authenticate(a, "postgres", "1.2.3.4", "wrong")
+		}
+		require.Equal(t, AuthLockedOut, events[2].Type)
+
+		// even the correct password is rejected, without being requested
+		rw, err := authenticate(a, "postgres", "5.6.7.8", "secret")
+		require.Error(t, err)
+		require.Equal(t, "28P01", fromErr(err).Code())
+		require.Len(t, rw.messages, 1)
+		require.True(t, rw.messages[0].IsError())
+		require.True(t, bytes.Contains(rw.messages[0], fatalMarker))
+		require.Equal(t, AuthRejected, events[3].Type)
+		require.Equal(t, 3, events[3].Failures)
+
+		// other users from other addresses aren't affected
+		_, err = authenticate(a, "other", "5.6.7.8", "secret")
+		require.NoError(t, err)
+	})
+
+	t.Run("locks out addresses", func(t *testing.T) {
+		a := newAuthenticator(limits)
+		for _, user := range []string{"a", "b", "c"} {
+			authenticate(a, user, "1.2.3.4", "wrong")
+		}
+		require.Equal(t, AuthLockedOut, events[2].Type)
+
+		_, err := authenticate(a, "postgres", "1.2.3.4", "secret")
+		require.Error(t, err)
+		require.Equal(t, AuthRejected, events[3].Type)
+
+		_, err = authenticate(a, "postgres", "5.6.7.8", "secret")
+		require.NoError(t, err)
+	})
+
+	t.Run("success resets the user's failures", func(t *testing.T) {
+		a := newAuthenticator(limits)
+		authenticate(a, "postgres", "1.2.3.4", "wrong")
+		authenticate(a, "postgres", "1.2.3.4", "wrong")
+		_, err := authenticate(a, "postgres", "5.6.7.8", "secret")
+		require.NoError(t, err)
+
+		authenticate(a, "postgres", "5.6.7.8", "wrong")
+		require.Equal(t, AuthFailed, events[2].Type)
+		require.Equal(t, 1, events[2].Failures)
+	})
+
+	t.Run("lockout expires", func(t *testing.T) {
+		a := newAuthenticator(limits)
+		for i := 0; i < 3; i++ {
+			authenticate(a, "postgres", "1.2.3.4", "wrong")
+		}
+
+		now = now.Add(30 * time.Second)
+		_, err := authenticate(a, "postgres", "1.2.3.4", "secret")
+		require.Error(t, err)
+
+		now = now.Add(30 * time.Second)
+		_, err = authenticate(a, "postgres", "1.2.3.4", "secret")
+		require.NoError(t, err)
+		require.Empty(t, a.users)
+		require.Empty(t, a.addrs)
+	})
+
+	t.Run("failures expire without lockouts", func(t *testing.T) {
+		a := newAuthenticator(AuthLimits{Delay: time.Second})
+		authenticate(a, "postgres", "1.2.3.4", "wrong")
+		authenticate(a, "postgres", "1.2.3.4", "wrong")
+
+		now = now.Add(defaultAuthFailuresTTL)
+		authenticate(a, "other", "5.6.7.8", "wrong")
+		require.Len(t, a.users, 1, "expected the expired failures to be swept")
+		require.Len(t, a.addrs, 1, "expected the expired failures to be swept")
+
+		authenticate(a, "postgres", "1.2.3.4", "wrong")
+		require.Equal(t, []time.Duration{time.Second, 2 * time.Second, time.Second, time.Second}, slept)
+	})
+
+	t.Run("remembers a limited number of failures", func(t *testing.T) {
+		a := newAuthenticator(limits)
+		a.maxEntries = 2
+		for _, user := range []string{"a", "b", "c"} {
+			now = now.Add(time.Second)
+			authenticate(a, user, "1.2.3.4", "wrong")
+		}
+		require.Len(t, a.users, 2)
+		require.NotContains(t, a.users, "a", "expected the oldest failures to be forgotten")
+	})
+
+	t.Run("other errors aren't failures", func(t *testing.T) {
+		a := newLimitedAuthenticator(&mockAuthenticator{}, limits)
+		a.sleep = func(time.Duration) {}
+		for i := 0; i < 5; i++ {
+			_, err := authenticate(a, "postgres", "1.2.3.4", "secret")
+			require.Equal(t, "28000", fromErr(err).Code())
+		}
+		require.Empty(t, a.users)
+		require.Empty(t, a.addrs)
+	})
+}
+
+func TestLimitedAuthenticator_concurrent(t *testing.T) {
+	var mu sync.Mutex
+	events := map[AuthEventType]int{}
+	wrapped := &blockingAuthenticator{release: make(chan struct{})}
+	a := newLimitedAuthenticator(wrapped, AuthLimits{
+		MaxFailures: 3,
+		Lockout:     time.Minute,
+		Observer: func(e AuthEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			events[e.Type]++
+		},
+	})
+
+	// all of the attempts are made while the first ones are still being
+	// authenticated
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			errs <- a.Authenticate(&mockMessageReadWriter{}, &Client{
+				RemoteAddr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4")},
+				Args:       map[string]interface{}{"user": "postgres"},
+			})
+		}()
+	}
+
+	receive := func() {
+		select {
+		case err := <-errs:
+			require.Equal(t, "28P01", fromErr(err).Code())
+		case <-time.After(time.Second):
+			t.Fatal("expected attempts beyond the limit to be rejected without authentication")
+		}
+	}
+	for i := 0; i < 7; i++ {
+		receive()
+	}
+	close(wrapped.release)
+	for i := 0; i < 3; i++ {
+		receive()
+	}
+
+	require.Equal(t, int32(3), atomic.LoadInt32(&wrapped.calls))
+	require.Equal(t, map[AuthEventType]int{AuthRejected: 7, AuthFailed: 2, AuthLockedOut: 1}, events)
+}
+
+// blockingAuthenticator fails the authentications as wrong passwords, once
+// it's released
+type blockingAuthenticator struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (a *blockingAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
+	atomic.AddInt32(&a.calls, 1)
+	<-a.release
+	return failAuthentication(rw, InvalidPassword("postgres"))
+}
+
+// passwordMsg returns a PasswordMessage of the clear text password
+func passwordMsg(password string) protocol.Message {
+	m := protocol.Message{'p', 0, 0, 0, byte(5 + len(password))}
+	return append(append(m, password...), 0)
+}
@@ -0,0 +1,279 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"reflect"
+)
+
+// parameter format codes, as provided by Bind messages
+const (
+	textFormat   int16 = 0
+	binaryFormat int16 = 1
+)
+
+// dataType looks up the data type of a declared statement parameter. Parameters
+// declared by the Parse message carry their OID, while the ones declared by
+// SQL PREPARE are only named.
+func (s *session) dataType(typ nodes.TypeName) (*pgtype.DataType, bool) {
+	if typ.TypeOid != 0 {
+		return s.ConnInfo.DataTypeForOID(pgtype.OID(typ.TypeOid))
+	}
+
+	// the type name might be qualified with its schema, like pg_catalog.int4
+	return s.ConnInfo.DataTypeForName(canonicalTypeName(typeNameString(typ)))
+}
+
+// decodeParams decodes the raw parameters of a Bind message into values of
+// the statement's declared types. The format codes follow the Bind message
+// semantics: no codes means all parameters are in text format, a single code
+// applies to all of the parameters, otherwise there's a code per parameter.
+func (s *session) decodeParams(ps *nodes.PrepareStmt, formats []int16, raw [][]byte) ([]pgtype.Value, error) {
+	if len(formats) > 1 && len(formats) != len(raw) {
+		msg := fmt.Sprintf("bind message has %d parameter formats but %d parameters", len(formats), len(raw))
+		return nil, ProtocolViolation(msg)
+	}
+
+	if len(raw) != len(ps.Argtypes.Items) {
+		msg := fmt.Sprintf("bind message supplies %d parameters, but prepared statement \"%s\" requires %d",
+			len(raw), stmtName(ps), len(ps.Argtypes.Items))
+		return nil, ProtocolViolation(msg)
+	}
+
+	values := make([]pgtype.Value, len(raw))
+	for i, src := range raw {
+		typ := ps.Argtypes.Items[i].(nodes.TypeName)
+		dt, ok := s.dataType(typ)
+		if !ok {
+			return nil, fmt.Errorf("cache lookup failed for type %d", typ.TypeOid)
+		}
+
+		format := textFormat
+		if len(formats) == 1 {
+			format = formats[0]
+		} else if len(formats) > 1 {
+			format = formats[i]
+		}
+
+		v := newValue(dt)
+		switch format {
+		case textFormat:
+			decoder, ok := v.(pgtype.TextDecoder)
+			if !ok || decoder.DecodeText(s.ConnInfo, src) != nil {
+				return nil, InvalidTextRepresentation(dt.Name, string(src))
+			}
+		case binaryFormat:
+			decoder, ok := v.(pgtype.BinaryDecoder)
+			if !ok {
+				return nil, UndefinedFunction("no binary input function available for type %s", dt.Name)
+			}
+			if decoder.DecodeBinary(s.ConnInfo, src) != nil {
+				return nil, InvalidBinaryRepresentation(i + 1)
+			}
+		default:
+			return nil, ProtocolViolation(fmt.Sprintf("unsupported format code: %d", format))
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// resultFormats returns the format of each of the result columns. Just like
+// the parameter format codes, no codes means all of the columns are in text
+// format, a single code applies to all of the columns, otherwise there's a
+// code per column.
+func resultFormats(formats []int16, numCols int) ([]int16, error) {
+	if len(formats) > 1 && len(formats) != numCols {
+		msg := fmt.Sprintf("bind message has %d result formats but query has %d columns", len(formats), numCols)
+		return nil, ProtocolViolation(msg)
+	}
+
+	res := make([]int16, numCols)
+	if len(formats) == 1 {
+		for i := range res {
+			res[i] = formats[0]
+		}
+	} else {
+		copy(res, formats)
+	}
+	return res, nil
+}
+
+// namedValues converts the decoded parameter values to arguments, in the same
+// form database/sql drivers receive them
+func namedValues(values []pgtype.Value) []driver.NamedValue {
+	args := make([]driver.NamedValue, len(values))
+	for i, v := range values {
+		args[i] = driver.NamedValue{Ordinal: i + 1, Value: v.Get()}
+		if valuer, ok := v.(driver.Valuer); ok {
+			// errors are ignored, the value was already successfully decoded
+			args[i].Value, _ = valuer.Value()
+		}
+	}
+	return args
+}
+
+// paramConst converts a decoded parameter value to a constant node, casted to
+// the parameter's declared type, just like the parser would for a literal such
+// as '1'::int4.
+func (s *session) paramConst(typ nodes.TypeName, v pgtype.Value, location int) (nodes.Node, error) {
+	var val nodes.Node
+	switch g := v.Get().(type) {
+	case nil:
+		val = nodes.Null{}
+	case int16:
+		val = nodes.Integer{Ival: int64(g)}
+	case int32:
+		val = nodes.Integer{Ival: int64(g)}
+	case int64:
+		val = nodes.Integer{Ival: g}
+	default:
+		encoder, ok := v.(pgtype.TextEncoder)
+		if !ok {
+			return nil, Unsupported("parameter of type %s", reflect.TypeOf(v))
+		}
+
+		text, err := encoder.EncodeText(s.ConnInfo, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		switch g.(type) {
+		case float32, float64:
+			val = nodes.Float{Str: string(text)}
+		default:
+			val = nodes.String{Str: string(text)}
+		}
+	}
+
+	return nodes.TypeCast{
+		Arg:      nodes.A_Const{Val: val, Location: location},
+		TypeName: &typ,
+		Location: location,
+	}, nil
+}
+
+// bindParams returns a copy of the statement's query, with all of its ParamRef
+// nodes replaced by constants of the provided parameter values.
+func (s *session) bindParams(ps *nodes.PrepareStmt, values []pgtype.Value) (nodes.Node, error) {
+	return replaceParams(ps.Query, len(values), func(i int, location int) (nodes.Node, error) {
+		typ := ps.Argtypes.Items[i].(nodes.TypeName)
+		return s.paramConst(typ, values[i], location)
+	})
+}
+
+// bindArgs returns a copy of the statement's query, with all of its ParamRef
+// nodes replaced by the argument expressions of SQL EXECUTE, casted to the
+// parameters' declared types.
+func (s *session) bindArgs(ps *nodes.PrepareStmt, args []nodes.Node) (nodes.Node, error) {
+	if len(args) != len(ps.Argtypes.Items) {
+		err := SyntaxError("wrong number of parameters for prepared statement \"%s\"", stmtName(ps))
+		return nil, WithDetail(err, "Expected %d parameters but got %d.", len(ps.Argtypes.Items), len(args))
+	}
+
+	return replaceParams(ps.Query, len(args), func(i int, location int) (nodes.Node, error) {
+		typ := ps.Argtypes.Items[i].(nodes.TypeName)
+		return nodes.TypeCast{Arg: args[i], TypeName: &typ, Location: location}, nil
+	})
+}
+
+// replaceParams returns a copy of the query, with all of its ParamRef nodes
+// replaced by the nodes fn returns for them, by their zero based index. Refs
+// to parameters beyond count are undefined.
+func replaceParams(query nodes.Node, count int, fn func(i int, location int) (nodes.Node, error)) (nodes.Node, error) {
+	var err error
+	query = rewrite(query, func(n nodes.Node) (nodes.Node, bool) {
+		ref, ok := n.(nodes.ParamRef)
+		if !ok || err != nil {
+			return nil, false
+		}
+
+		if ref.Number < 1 || ref.Number > count {
+			err = UndefinedParameter(ref.Number)
+			return nil, false
+		}
+
+		n, err = fn(ref.Number-1, ref.Location)
+		return n, err == nil
+	})
+	return query, err
+}
+
+// stmtName returns the name of the prepared statement, which is empty for the
+// unnamed statement
+func stmtName(ps *nodes.PrepareStmt) string {
+	if ps.Name == nil {
+		return ""
+	}
+	return *ps.Name
+}
+
+// rewrite returns a deep copy of the provided tree, where every node for which
+// fn reports true is replaced by the node it returns. Nodes that are replaced
+// aren't traversed any further.
+func rewrite(n nodes.Node, fn func(nodes.Node) (nodes.Node, bool)) nodes.Node {
+	if n == nil {
+		return nil
+	}
+
+	v := rewriteValue(reflect.ValueOf(&n).Elem(), fn)
+	return v.Interface().(nodes.Node)
+}
+
+// walk visits every node of the provided tree, parents before their children
+func walk(n nodes.Node, fn func(nodes.Node)) {
+	rewrite(n, func(n nodes.Node) (nodes.Node, bool) {
+		fn(n)
+		return nil, false
+	})
+}
+
+func rewriteValue(v reflect.Value, fn func(nodes.Node) (nodes.Node, bool)) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+
+		res := reflect.New(v.Type()).Elem()
+		if n, ok := v.Interface().(nodes.Node); ok {
+			if replacement, ok := fn(n); ok {
+				res.Set(reflect.ValueOf(replacement))
+				return res
+			}
+		}
+		res.Set(rewriteValue(v.Elem(), fn))
+		return res
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+
+		res := reflect.New(v.Type().Elem())
+		res.Elem().Set(rewriteValue(v.Elem(), fn))
+		return res
+	case reflect.Struct:
+		res := reflect.New(v.Type()).Elem()
+		res.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if res.Field(i).CanSet() {
+				res.Field(i).Set(rewriteValue(v.Field(i), fn))
+			}
+		}
+		return res
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+
+		res := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			res.Index(i).Set(rewriteValue(v.Index(i), fn))
+		}
+		return res
+	default:
+		return v
+	}
+}
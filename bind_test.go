@@ -0,0 +1,262 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/jackc/pgx/pgtype"
+	parser "github.com/lfittl/pg_query_go"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func typeName(oid nodes.Oid, name string) nodes.TypeName {
+	return nodes.TypeName{
+		TypeOid: oid,
+		Names:   nodes.List{Items: []nodes.Node{nodes.String{Str: name}}},
+	}
+}
+
+func preparedStatement(t *testing.T, query string, argtypes ...nodes.Node) *nodes.PrepareStmt {
+	tree, err := parser.Parse(query)
+	require.NoError(t, err)
+	return &nodes.PrepareStmt{
+		Name:     &testStmtName,
+		Query:    tree.Statements[0],
+		Argtypes: nodes.List{Items: argtypes},
+	}
+}
+
+func TestSession_decodeParams(t *testing.T) {
+	sess := &session{ConnInfo: newConnInfo()}
+	ps := preparedStatement(t, "SELECT $1, $2", typeName(23, "int4"), typeName(25, "text"))
+
+	t.Run("text format", func(t *testing.T) {
+		values, err := sess.decodeParams(ps, nil, [][]byte{[]byte("42"), []byte("foo")})
+		require.NoError(t, err)
+		require.Len(t, values, 2)
+		require.Equal(t, int32(42), values[0].Get())
+		require.Equal(t, "foo", values[1].Get())
+	})
+	t.Run("mixed formats", func(t *testing.T) {
+		values, err := sess.decodeParams(ps, []int16{1, 0}, [][]byte{{0, 0, 0, 42}, []byte("foo")})
+		require.NoError(t, err)
+		require.Equal(t, int32(42), values[0].Get())
+		require.Equal(t, "foo", values[1].Get())
+	})
+	t.Run("null", func(t *testing.T) {
+		values, err := sess.decodeParams(ps, nil, [][]byte{nil, nil})
+		require.NoError(t, err)
+		require.Nil(t, values[0].Get())
+		require.Nil(t, values[1].Get())
+	})
+	t.Run("named types", func(t *testing.T) {
+		ps := preparedStatement(t, "SELECT $1", nodes.TypeName{
+			Names: nodes.List{Items: []nodes.Node{nodes.String{Str: "pg_catalog"}, nodes.String{Str: "int4"}}},
+		})
+		values, err := sess.decodeParams(ps, nil, [][]byte{[]byte("42")})
+		require.NoError(t, err)
+		require.Equal(t, int32(42), values[0].Get())
+	})
+	t.Run("fails on wrong number of parameters", func(t *testing.T) {
+		_, err := sess.decodeParams(ps, nil, [][]byte{[]byte("42")})
+		require.Error(t, err)
+		require.Equal(t, "08P01", fromErr(err).Code())
+		require.Equal(t, "bind message supplies 1 parameters, but prepared statement \"test_stmt\" requires 2", err.Error())
+	})
+	t.Run("fails on wrong number of formats", func(t *testing.T) {
+		_, err := sess.decodeParams(ps, []int16{0, 0, 0}, [][]byte{[]byte("42"), []byte("foo")})
+		require.Error(t, err)
+		require.Equal(t, "08P01", fromErr(err).Code())
+	})
+	t.Run("fails on invalid text", func(t *testing.T) {
+		_, err := sess.decodeParams(ps, nil, [][]byte{[]byte("baa"), []byte("foo")})
+		require.Error(t, err)
+		require.Equal(t, "22P02", fromErr(err).Code())
+		require.Equal(t, "invalid input syntax for type int4: \"baa\"", err.Error())
+	})
+	t.Run("fails on types without binary format", func(t *testing.T) {
+		ps := preparedStatement(t, "SELECT $1", typeName(142, "xml"))
+		_, err := sess.decodeParams(ps, []int16{1}, [][]byte{[]byte("<a/>")})
+		require.Error(t, err)
+		require.Equal(t, "42883", fromErr(err).Code())
+		require.Equal(t, "no binary input function available for type xml", err.Error())
+	})
+	t.Run("fails on invalid binary", func(t *testing.T) {
+		_, err := sess.decodeParams(ps, []int16{1}, [][]byte{{42}, []byte("foo")})
+		require.Error(t, err)
+		require.Equal(t, "22P03", fromErr(err).Code())
+	})
+}
+
+func TestResultFormats(t *testing.T) {
+	formats, err := resultFormats(nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int16{0, 0}, formats)
+
+	formats, err = resultFormats([]int16{1}, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int16{1, 1}, formats)
+
+	formats, err = resultFormats([]int16{0, 1}, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int16{0, 1}, formats)
+
+	_, err = resultFormats([]int16{0, 1}, 3)
+	require.Error(t, err)
+	require.Equal(t, "08P01", fromErr(err).Code())
+}
+
+func TestNamedValues(t *testing.T) {
+	sess := &session{ConnInfo: newConnInfo()}
+	ps := preparedStatement(t, "SELECT $1, $2, $3", typeName(23, "int4"), typeName(25, "text"), typeName(16, "bool"))
+	values, err := sess.decodeParams(ps, nil, [][]byte{[]byte("42"), []byte("foo"), nil})
+	require.NoError(t, err)
+
+	args := namedValues(values)
+	require.Equal(t, []driver.NamedValue{
+		{Ordinal: 1, Value: int64(42)},
+		{Ordinal: 2, Value: "foo"},
+		{Ordinal: 3, Value: nil},
+	}, args)
+}
+
+func TestSession_bindParams(t *testing.T) {
+	sess := &session{ConnInfo: newConnInfo()}
+
+	t.Run("replaces parameters with constants", func(t *testing.T) {
+		ps := preparedStatement(t, "SELECT * FROM t WHERE a = $1 AND b = $2 AND c = $1",
+			typeName(23, "int4"), typeName(25, "text"))
+		values, err := sess.decodeParams(ps, nil, [][]byte{[]byte("42"), nil})
+		require.NoError(t, err)
+
+		query, err := sess.bindParams(ps, values)
+		require.NoError(t, err)
+
+		where := query.(nodes.RawStmt).Stmt.(nodes.SelectStmt).WhereClause.(nodes.BoolExpr).Args.Items
+		require.Len(t, where, 3)
+
+		a := where[0].(nodes.A_Expr).Rexpr.(nodes.TypeCast)
+		require.Equal(t, nodes.A_Const{Val: nodes.Integer{Ival: 42}, Location: 26}, a.Arg)
+		require.Equal(t, nodes.Oid(23), a.TypeName.TypeOid)
+
+		b := where[1].(nodes.A_Expr).Rexpr.(nodes.TypeCast)
+		require.Equal(t, nodes.Null{}, b.Arg.(nodes.A_Const).Val)
+		require.Equal(t, nodes.Oid(25), b.TypeName.TypeOid)
+
+		c := where[2].(nodes.A_Expr).Rexpr.(nodes.TypeCast)
+		require.Equal(t, nodes.Integer{Ival: 42}, c.Arg.(nodes.A_Const).Val)
+
+		// the prepared statement itself remains untouched
+		where = ps.Query.(nodes.RawStmt).Stmt.(nodes.SelectStmt).WhereClause.(nodes.BoolExpr).Args.Items
+		require.IsType(t, nodes.ParamRef{}, where[0].(nodes.A_Expr).Rexpr)
+	})
+	t.Run("text constants", func(t *testing.T) {
+		ps := preparedStatement(t, "SELECT $1", typeName(25, "text"))
+		query, err := sess.bindParams(ps, []pgtype.Value{&pgtype.Text{String: "foo", Status: pgtype.Present}})
+		require.NoError(t, err)
+
+		target := query.(nodes.RawStmt).Stmt.(nodes.SelectStmt).TargetList.Items[0].(nodes.ResTarget)
+		require.Equal(t, nodes.String{Str: "foo"}, target.Val.(nodes.TypeCast).Arg.(nodes.A_Const).Val)
+	})
+	t.Run("fails on undefined parameters", func(t *testing.T) {
+		ps := preparedStatement(t, "SELECT $2", typeName(25, "text"))
+		_, err := sess.bindParams(ps, []pgtype.Value{&pgtype.Text{String: "foo", Status: pgtype.Present}})
+		require.Error(t, err)
+		require.Equal(t, "42P02", fromErr(err).Code())
+		require.Equal(t, "there is no parameter $2", err.Error())
+	})
+}
+
+func TestSession_bindArgs(t *testing.T) {
+	sess := &session{ConnInfo: newConnInfo()}
+	ps := preparedStatement(t, "SELECT $1, $2", typeName(23, "int4"), typeName(25, "text"))
+	args, err := parser.Parse("SELECT 1, upper('foo')")
+	require.NoError(t, err)
+	exprs := args.Statements[0].(nodes.RawStmt).Stmt.(nodes.SelectStmt).TargetList.Items
+
+	t.Run("replaces parameters with casted arguments", func(t *testing.T) {
+		query, err := sess.bindArgs(ps, []nodes.Node{
+			exprs[0].(nodes.ResTarget).Val,
+			exprs[1].(nodes.ResTarget).Val,
+		})
+		require.NoError(t, err)
+
+		targets := query.(nodes.RawStmt).Stmt.(nodes.SelectStmt).TargetList.Items
+		first := targets[0].(nodes.ResTarget).Val.(nodes.TypeCast)
+		require.Equal(t, nodes.Integer{Ival: 1}, first.Arg.(nodes.A_Const).Val)
+		require.Equal(t, nodes.Oid(23), first.TypeName.TypeOid)
+
+		second := targets[1].(nodes.ResTarget).Val.(nodes.TypeCast)
+		require.IsType(t, nodes.FuncCall{}, second.Arg)
+		require.Equal(t, nodes.Oid(25), second.TypeName.TypeOid)
+	})
+	t.Run("fails on wrong number of arguments", func(t *testing.T) {
+		_, err := sess.bindArgs(ps, []nodes.Node{exprs[0].(nodes.ResTarget).Val})
+		require.Error(t, err)
+		require.Equal(t, "42601", fromErr(err).Code())
+		require.Equal(t, "wrong number of parameters for prepared statement \"test_stmt\"", err.Error())
+		require.Equal(t, "Expected 2 parameters but got 1.", fromErr(err).Detail())
+	})
+}
+
+func TestSession_bind_parameters(t *testing.T) {
+	sess := &session{
+		ConnInfo:     newConnInfo(),
+		stmts:        map[string]*nodes.PrepareStmt{},
+		pendingStmts: map[string]*nodes.PrepareStmt{},
+		portals:      map[string]*portal{},
+	}
+	sess.storePreparedStatement(preparedStatement(t, "SELECT $1", typeName(23, "int4")))
+
+	t.Run("binds the parameters", func(t *testing.T) {
+		msgs, err := sess.bind(protocol.NewTransport(nil), &pgproto3.Bind{
+			PreparedStatement: testStmtName,
+			Parameters:        [][]byte{[]byte("1")},
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.False(t, msgs[0].IsError())
+
+		target := sess.portals[""].query.(nodes.RawStmt).Stmt.(nodes.SelectStmt).TargetList.Items[0].(nodes.ResTarget)
+		require.IsType(t, nodes.TypeCast{}, target.Val)
+	})
+	t.Run("keeps the result formats", func(t *testing.T) {
+		msgs, err := sess.bind(protocol.NewTransport(nil), &pgproto3.Bind{
+			PreparedStatement: testStmtName,
+			Parameters:        [][]byte{[]byte("1")},
+			ResultFormatCodes: []int16{1},
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.False(t, msgs[0].IsError())
+		require.Equal(t, []int16{1}, sess.portals[""].formats)
+	})
+	t.Run("fails on unsupported result formats", func(t *testing.T) {
+		msgs, err := sess.bind(protocol.NewTransport(nil), &pgproto3.Bind{
+			PreparedStatement: testStmtName,
+			Parameters:        [][]byte{[]byte("1")},
+			ResultFormatCodes: []int16{2},
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		errorRes, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "08P01", errorRes.Code)
+	})
+	t.Run("fails on invalid parameters", func(t *testing.T) {
+		msgs, err := sess.bind(protocol.NewTransport(nil), &pgproto3.Bind{
+			DestinationPortal: "invalid",
+			PreparedStatement: testStmtName,
+			Parameters:        [][]byte{[]byte("baa")},
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.True(t, msgs[0].IsError())
+		errorRes, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "22P02", errorRes.Code)
+		require.Nil(t, sess.portals["invalid"])
+	})
+}
@@ -0,0 +1,71 @@
+package pgsrv
+
+import (
+	"crypto/x509"
+	"github.com/panoplyio/pgsrv/protocol"
+)
+
+// certAuthenticator authenticates clients by their TLS certificates, without
+// requesting passwords. The certificates must be verified by the server's TLS
+// configuration (see WithClientCAs), and issued to the user: the common name of
+// the certificate must be the name of the user. With a user name map, the
+// common name, or one of the subject alternative names, of the certificate
+// must be mapped to the user instead.
+type certAuthenticator struct {
+	ident   *Ident // the user name maps, nil if there are none
+	mapName string // the map of the identities of certificates, empty for none
+}
+
+func (a *certAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
+	user, _ := client.Args["user"].(string)
+	err := a.verify(client, user, true)
+	if err != nil {
+		rw.Write(protocol.ErrorResponse(err))
+		return err
+	}
+
+	return rw.Write(authOKMsg())
+}
+
+// verify verifies that the client presented a certificate that was verified by
+// the server's TLS configuration. When full is set, the certificate must also
+// be issued to the user.
+func (a *certAuthenticator) verify(client *Client, user string, full bool) error {
+	if client.TLS == nil || len(client.TLS.VerifiedChains) == 0 {
+		return InvalidAuthorizationSpecification("connection requires a valid client certificate")
+	}
+	if !full {
+		return nil
+	}
+
+	cert := client.TLS.VerifiedChains[0][0]
+	if a.mapName == "" {
+		// just like in Postgres, only the common name identifies the user
+		// unless the identities are explicitly mapped to users
+		if cert.Subject.CommonName != "" && cert.Subject.CommonName == user {
+			return nil
+		}
+	} else {
+		for _, identity := range certIdentities(cert) {
+			if a.ident.Maps(a.mapName, identity, user) {
+				return nil
+			}
+		}
+	}
+	return InvalidAuthorizationSpecification("certificate authentication failed for user \"%s\"", user)
+}
+
+// certIdentities returns the names the certificate is issued to: its common
+// name, followed by its DNS names, email addresses and URIs
+func certIdentities(cert *x509.Certificate) []string {
+	var identities []string
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+	identities = append(identities, cert.DNSNames...)
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	return identities
+}
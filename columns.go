@@ -0,0 +1,103 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/panoplyio/pgsrv/protocol"
+	"math"
+)
+
+// varHdrSz is the size of the header of variable-width values, which is
+// included in the type modifiers of character and numeric types
+const varHdrSz = 4
+
+// numericMaxPrecision is the maximum precision of declared numerics
+const numericMaxPrecision = 1000
+
+// rowDescription builds the RowDescription message of the provided rows, with
+// their columns in the requested result formats
+func (q *query) rowDescription(rows driver.Rows, formats []int16) (protocol.Message, error) {
+	cols, err := q.columns(rows, formats)
+	if err != nil {
+		return nil, err
+	}
+	return protocol.RowDescription(cols), nil
+}
+
+// columns describes the columns of the provided rows, in the requested result
+// formats. The metadata is provided by the optional driver.RowsColumnType*
+// interfaces and RowsColumnSource. Columns of unspecified types are text.
+func (q *query) columns(rows driver.Rows, formats []int16) ([]protocol.Column, error) {
+	names := rows.Columns()
+	formats, err := resultFormats(formats, len(names))
+	if err != nil {
+		return nil, err
+	}
+
+	typeNames, _ := rows.(driver.RowsColumnTypeDatabaseTypeName)
+	source, _ := rows.(RowsColumnSource)
+	cols := make([]protocol.Column, len(names))
+	for i, name := range names {
+		var typeName string
+		if typeNames != nil {
+			typeName = typeNames.ColumnTypeDatabaseTypeName(i)
+		}
+
+		typ, ok := q.types.ByName(typeName)
+		if !ok {
+			typ, _ = q.types.ByOID(pgtype.TextOID)
+		}
+		if typ.Base != 0 {
+			// domains are described as their base types
+			typ, _ = q.types.ByOID(typ.Base)
+		}
+
+		cols[i] = protocol.Column{
+			Name:    name,
+			TypeOid: uint32(typ.OID),
+			TypeLen: typ.Len,
+			TypeMod: typeMod(rows, i, typ.OID),
+			Format:  formats[i],
+		}
+		if source != nil {
+			if tableOid, attrNum, ok := source.ColumnSource(i); ok {
+				cols[i].TableOid, cols[i].AttrNum = tableOid, attrNum
+			}
+		}
+	}
+	return cols, nil
+}
+
+// typeMod returns the type modifier of the column, which is -1 unless it's
+// specified. The length of character types is provided by
+// driver.RowsColumnTypeLength, while the precision and scale of numerics are
+// provided by driver.RowsColumnTypePrecisionScale. Unbounded types, reported
+// with the maximum length, have no modifier.
+func typeMod(rows driver.Rows, index int, oid pgtype.OID) int32 {
+	switch oid {
+	case pgtype.VarcharOID, pgtype.BPCharOID:
+		lengths, ok := rows.(driver.RowsColumnTypeLength)
+		if !ok {
+			return -1
+		}
+
+		length, ok := lengths.ColumnTypeLength(index)
+		if !ok || length <= 0 || length > math.MaxInt32-varHdrSz {
+			return -1
+		}
+		return int32(length) + varHdrSz
+	case pgtype.NumericOID:
+		decimals, ok := rows.(driver.RowsColumnTypePrecisionScale)
+		if !ok {
+			return -1
+		}
+
+		precision, scale, ok := decimals.ColumnTypePrecisionScale(index)
+		if !ok || precision <= 0 || precision > numericMaxPrecision || scale < 0 || scale > precision {
+			return -1
+		}
+		return int32(precision<<16|scale) + varHdrSz
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,67 @@
+package pgsrv
+
+import (
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+// mockDescribedRows describes a varchar(255), numeric(10, 2), unbounded
+// varchar and an untyped column
+type mockDescribedRows struct {
+	mockRows
+}
+
+func (r *mockDescribedRows) Columns() []string { return []string{"a", "b", "c", "d"} }
+func (r *mockDescribedRows) ColumnTypeDatabaseTypeName(index int) string {
+	return []string{"VARCHAR", "NUMERIC", "varchar", ""}[index]
+}
+func (r *mockDescribedRows) ColumnTypeLength(index int) (int64, bool) {
+	switch index {
+	case 0:
+		return 255, true
+	case 2:
+		return math.MaxInt64, true
+	default:
+		return 0, false
+	}
+}
+func (r *mockDescribedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if index == 1 {
+		return 10, 2, true
+	}
+	return 0, 0, false
+}
+func (r *mockDescribedRows) ColumnSource(index int) (uint32, int16, bool) {
+	if index == 0 {
+		return 16384, 3, true
+	}
+	return 0, 0, false
+}
+
+func TestQuery_columns(t *testing.T) {
+	sess := &session{Server: &server{queryer: &mockQueryer{}}}
+	q := sess.newQuery(nil, "")
+
+	t.Run("describes the columns", func(t *testing.T) {
+		cols, err := q.columns(&mockDescribedRows{}, []int16{1})
+		require.NoError(t, err)
+		require.Equal(t, []protocol.Column{
+			{Name: "a", TableOid: 16384, AttrNum: 3, TypeOid: 1043, TypeLen: -1, TypeMod: 259, Format: 1},
+			{Name: "b", TypeOid: 1700, TypeLen: -1, TypeMod: 10<<16 | 2 + 4, Format: 1},
+			{Name: "c", TypeOid: 1043, TypeLen: -1, TypeMod: -1, Format: 1},
+			{Name: "d", TypeOid: 25, TypeLen: -1, TypeMod: -1, Format: 1},
+		}, cols)
+	})
+	t.Run("fixed size types", func(t *testing.T) {
+		cols, err := q.columns(&mockTypedRows{}, nil)
+		require.NoError(t, err)
+		require.Equal(t, protocol.Column{Name: "a", TypeOid: 23, TypeLen: 4, TypeMod: -1}, cols[0])
+	})
+	t.Run("untyped rows", func(t *testing.T) {
+		cols, err := q.columns(&mockRows{}, nil)
+		require.NoError(t, err)
+		require.Equal(t, []protocol.Column{{Name: "column1", TypeOid: 25, TypeLen: -1, TypeMod: -1}}, cols)
+	})
+}
@@ -0,0 +1,285 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	"strings"
+)
+
+// compositeValue is a value of a composite type. Its fields are encoded and
+// decoded by the implementations of their types.
+type compositeValue struct {
+	names  []string
+	oids   []pgtype.OID
+	fields []pgtype.Value // the registered values of the field types
+	values []pgtype.Value
+	status pgtype.Status
+}
+
+func (dst *compositeValue) Set(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		dst.values, dst.status = nil, pgtype.Null
+		return nil
+	case string:
+		return dst.DecodeText(nil, []byte(value))
+	case []byte:
+		return dst.DecodeText(nil, value)
+	case []interface{}:
+		if len(value) != len(dst.fields) {
+			return fmt.Errorf("cannot convert %d values to a composite of %d fields", len(value), len(dst.fields))
+		}
+
+		values := make([]pgtype.Value, len(value))
+		for i, v := range value {
+			values[i] = cloneValue(dst.fields[i])
+			if err := values[i].Set(v); err != nil {
+				return err
+			}
+		}
+		dst.values, dst.status = values, pgtype.Present
+		return nil
+	case map[string]interface{}:
+		values := make([]interface{}, len(dst.names))
+		for i, name := range dst.names {
+			values[i] = value[name]
+		}
+		return dst.Set(values)
+	default:
+		return fmt.Errorf("cannot convert %v to composite", value)
+	}
+}
+
+func (dst *compositeValue) Get() interface{} {
+	switch dst.status {
+	case pgtype.Present:
+		values := make([]interface{}, len(dst.values))
+		for i, v := range dst.values {
+			values[i] = v.Get()
+		}
+		return values
+	case pgtype.Null:
+		return nil
+	default:
+		return dst.status
+	}
+}
+
+func (src *compositeValue) AssignTo(dst interface{}) error {
+	v, ok := dst.(*[]interface{})
+	if !ok || src.status != pgtype.Present {
+		return fmt.Errorf("cannot assign %v to %T", src, dst)
+	}
+	*v = src.Get().([]interface{})
+	return nil
+}
+
+func (dst *compositeValue) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		return dst.Set(nil)
+	}
+
+	fields, err := parseRecord(string(src))
+	if err != nil {
+		return err
+	}
+	if len(fields) != len(dst.fields) {
+		return fmt.Errorf("malformed record literal: \"%s\"", src)
+	}
+
+	values := make([]pgtype.Value, len(fields))
+	for i, f := range fields {
+		values[i] = cloneValue(dst.fields[i])
+		decoder, ok := values[i].(pgtype.TextDecoder)
+		if !ok {
+			return fmt.Errorf("cannot decode fields of type %T", dst.fields[i])
+		}
+
+		var fieldSrc []byte
+		if f != nil {
+			fieldSrc = []byte(*f)
+		}
+		if err := decoder.DecodeText(ci, fieldSrc); err != nil {
+			return err
+		}
+	}
+
+	dst.values, dst.status = values, pgtype.Present
+	return nil
+}
+
+func (dst *compositeValue) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		return dst.Set(nil)
+	}
+
+	if len(src) < 4 || int(binary.BigEndian.Uint32(src)) != len(dst.fields) {
+		return fmt.Errorf("wrong number of columns in composite")
+	}
+
+	rp := 4
+	values := make([]pgtype.Value, len(dst.fields))
+	for i := range values {
+		values[i] = cloneValue(dst.fields[i])
+		decoder, ok := values[i].(pgtype.BinaryDecoder)
+		if !ok {
+			return fmt.Errorf("cannot decode fields of type %T", dst.fields[i])
+		}
+
+		// each field is preceded by its type OID, which is known, and length
+		if len(src[rp:]) < 8 {
+			return fmt.Errorf("composite field %d is missing", i)
+		}
+		length := int32(binary.BigEndian.Uint32(src[rp+4:]))
+		rp += 8
+
+		var fieldSrc []byte
+		if length >= 0 {
+			if len(src[rp:]) < int(length) {
+				return fmt.Errorf("composite field %d is too short", i)
+			}
+			fieldSrc = src[rp : rp+int(length)]
+			rp += int(length)
+		}
+		if err := decoder.DecodeBinary(ci, fieldSrc); err != nil {
+			return err
+		}
+	}
+
+	dst.values, dst.status = values, pgtype.Present
+	return nil
+}
+
+func (src *compositeValue) EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+
+	buf = append(buf, '(')
+	for i, v := range src.values {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+
+		text, err := formatText(ci, v)
+		if err != nil {
+			return nil, err
+		}
+		if text != nil {
+			// NULLs are omitted
+			buf = append(buf, quoteRecordField(string(text))...)
+		}
+	}
+	return append(buf, ')'), nil
+}
+
+func (src *compositeValue) EncodeBinary(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(len(src.values)))
+	buf = append(buf, b...)
+	for i, v := range src.values {
+		encoder, ok := v.(pgtype.BinaryEncoder)
+		if !ok {
+			return nil, fmt.Errorf("cannot encode fields of type %T", v)
+		}
+
+		binary.BigEndian.PutUint32(b, uint32(src.oids[i]))
+		buf = append(buf, b...)
+
+		sp := len(buf)
+		buf = append(buf, 0, 0, 0, 0)
+		fieldBuf, err := encoder.EncodeBinary(ci, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if v.Get() == nil {
+			binary.BigEndian.PutUint32(buf[sp:], 0xFFFFFFFF)
+			continue
+		}
+		buf = fieldBuf
+		binary.BigEndian.PutUint32(buf[sp:], uint32(len(buf)-sp-4))
+	}
+	return buf, nil
+}
+
+// Value implements the database/sql/driver Valuer interface, with the text
+// format of the composite
+func (src *compositeValue) Value() (driver.Value, error) {
+	buf, err := src.EncodeText(nil, nil)
+	if err != nil || buf == nil {
+		return nil, err
+	}
+	return string(buf), nil
+}
+
+// parseRecord parses the fields of a record in text format, like (1,"a b",).
+// Fields that are omitted, rather than quoted, are NULLs.
+func parseRecord(src string) ([]*string, error) {
+	s := strings.TrimSpace(src)
+	if len(s) < 2 || s[0] != '(' || s[len(s)-1] != ')' {
+		return nil, fmt.Errorf("malformed record literal: \"%s\"", src)
+	}
+	s = s[1 : len(s)-1]
+
+	var fields []*string
+	for i := 0; ; i++ {
+		var b strings.Builder
+		null := true
+		for ; i < len(s) && s[i] != ','; i++ {
+			null = false
+			if s[i] != '"' {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+				continue
+			}
+
+			// quoted characters, where quotes are escaped by doubling them
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					if i+1 >= len(s) || s[i+1] != '"' {
+						break
+					}
+					i++
+				} else if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+		}
+
+		if null {
+			fields = append(fields, nil)
+		} else {
+			field := b.String()
+			fields = append(fields, &field)
+		}
+
+		if i >= len(s) {
+			return fields, nil
+		}
+	}
+}
+
+// quoteRecordField quotes a field of a record in text format, when it's
+// required for it to be read back, just like Postgres does
+func quoteRecordField(s string) string {
+	if s != "" && !strings.ContainsAny(s, "\"\\(), \t\n\r\v\f") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`"`, `""`, `\`, `\\`).Replace(s) + `"`
+}
@@ -0,0 +1,57 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgtype"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseRecord(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	fields, err := parseRecord(`(1,"a ""b""",,"",c\,d)`)
+	require.NoError(t, err)
+	require.Equal(t, []*string{str("1"), str(`a "b"`), nil, str(""), str("c,d")}, fields)
+
+	fields, err = parseRecord("()")
+	require.NoError(t, err)
+	require.Equal(t, []*string{nil}, fields)
+
+	_, err = parseRecord("1,2")
+	require.Error(t, err)
+}
+
+func TestCompositeValue(t *testing.T) {
+	types := NewTypes()
+	typ, err := types.RegisterComposite("pair", Field{"a", "int4"}, Field{"b", "text"})
+	require.NoError(t, err)
+	ci := types.connInfo()
+
+	t.Run("text format", func(t *testing.T) {
+		buf, err := encodeText(ci, typ.OID, map[string]interface{}{"a": nil, "b": `x "y"`})
+		require.NoError(t, err)
+		require.Equal(t, `(,"x ""y""")`, string(buf))
+
+		v := newValue(dataTypeForOID(ci, typ.OID))
+		require.NoError(t, v.(pgtype.TextDecoder).DecodeText(ci, buf))
+		require.Equal(t, []interface{}{nil, `x "y"`}, v.Get())
+	})
+	t.Run("binary format", func(t *testing.T) {
+		buf, err := encodeBinary(ci, typ.OID, []interface{}{int64(1), nil})
+		require.NoError(t, err)
+		require.Equal(t, []byte{
+			0, 0, 0, 2, // fields
+			0, 0, 0, 23, 0, 0, 0, 4, 0, 0, 0, 1, // 1
+			0, 0, 0, 25, 255, 255, 255, 255, // NULL
+		}, buf)
+
+		v := newValue(dataTypeForOID(ci, typ.OID))
+		require.NoError(t, v.(pgtype.BinaryDecoder).DecodeBinary(ci, buf))
+		require.Equal(t, []interface{}{int32(1), nil}, v.Get())
+	})
+	t.Run("fails on wrong number of fields", func(t *testing.T) {
+		v := newValue(dataTypeForOID(ci, typ.OID))
+		require.Error(t, v.Set([]interface{}{1}))
+		require.Error(t, v.(pgtype.TextDecoder).DecodeText(ci, []byte("(1,2,3)")))
+	})
+}
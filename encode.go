@@ -0,0 +1,221 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// encodeText encodes a value returned by the backend in the text format of the
+// column's type, exactly as Postgres outputs it. NULLs are encoded as nil.
+func encodeText(ci *pgtype.ConnInfo, oid pgtype.OID, v driver.Value) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	value := newValue(dataTypeForOID(ci, oid))
+	if value.Set(v) != nil {
+		// the value can't be converted to the column's type, like a string
+		// of a custom format, so it's sent as is
+		return fallbackText(v), nil
+	}
+	return formatText(ci, value)
+}
+
+// formatText encodes a value in its text format, exactly as Postgres outputs
+// it. NULLs are encoded as nil.
+func formatText(ci *pgtype.ConnInfo, value pgtype.Value) ([]byte, error) {
+	if value.Get() == nil {
+		return nil, nil
+	}
+
+	switch val := value.(type) {
+	case *pgtype.Float4:
+		return []byte(formatFloat(float64(val.Float), 32)), nil
+	case *pgtype.Float8:
+		return []byte(formatFloat(val.Float, 64)), nil
+	case *pgtype.Numeric:
+		return []byte(formatNumeric(val.Int, val.Exp)), nil
+	case *pgtype.Timestamp:
+		return []byte(val.Time.Round(time.Microsecond).Format("2006-01-02 15:04:05.999999")), nil
+	case *pgtype.Timestamptz:
+		// timestamps with time zone are output in UTC
+		return []byte(val.Time.UTC().Round(time.Microsecond).Format("2006-01-02 15:04:05.999999-07")), nil
+	case *pgtype.Interval:
+		return []byte(formatInterval(val.Months, val.Days, val.Microseconds)), nil
+	case *pgtype.QChar:
+		return []byte{byte(val.Int)}, nil
+	}
+
+	encoder, ok := value.(pgtype.TextEncoder)
+	if !ok {
+		return nil, UndefinedFunction("no output function available for type %T", value)
+	}
+
+	buf, err := encoder.EncodeText(ci, nil)
+	if err == nil && buf == nil {
+		// an empty value, rather than NULL
+		buf = []byte{}
+	}
+	return buf, err
+}
+
+// encodeBinary encodes a value returned by the backend in the binary format of
+// the column's type. NULLs are encoded as nil.
+func encodeBinary(ci *pgtype.ConnInfo, oid pgtype.OID, v driver.Value) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	dt := dataTypeForOID(ci, oid)
+	value := newValue(dt)
+	if value.Set(v) != nil {
+		if dt.OID == pgtype.TextOID {
+			// the binary format of text is the text itself
+			return fallbackText(v), nil
+		}
+		return nil, DatatypeMismatch("cannot convert %v of type %T to %s", v, v, dt.Name)
+	}
+
+	encoder, ok := value.(pgtype.BinaryEncoder)
+	if !ok {
+		return nil, UndefinedFunction("no binary output function available for type %s", dt.Name)
+	}
+
+	buf, err := encoder.EncodeBinary(ci, nil)
+	if err == nil && buf == nil {
+		// an empty value, rather than NULL
+		buf = []byte{}
+	}
+	return buf, err
+}
+
+// dataTypeForOID looks up the data type of a column, falling back to text for
+// unknown types
+func dataTypeForOID(ci *pgtype.ConnInfo, oid pgtype.OID) *pgtype.DataType {
+	dt, ok := ci.DataTypeForOID(oid)
+	if !ok {
+		dt, _ = ci.DataTypeForName("text")
+	}
+	return dt
+}
+
+// fallbackText encodes a value that doesn't match its column's type, by the
+// Postgres type that matches its own type. Columns are of type text unless
+// the backend specifies otherwise.
+func fallbackText(v driver.Value) []byte {
+	switch val := v.(type) {
+	case []byte:
+		return val
+	case string:
+		return []byte(val)
+	case bool:
+		if val {
+			return []byte("t")
+		}
+		return []byte("f")
+	case float64:
+		return []byte(formatFloat(val, 64))
+	case time.Time:
+		return []byte(val.UTC().Round(time.Microsecond).Format("2006-01-02 15:04:05.999999-07"))
+	default:
+		return []byte(fmt.Sprintf("%v", v))
+	}
+}
+
+// formatFloat formats a float with the shortest representation that is read
+// back precisely. Just like Postgres, the exponent notation is used for large
+// and small exponents.
+func formatFloat(f float64, bitSize int) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+
+	// the number of significant digits of the type (DBL_DIG or FLT_DIG)
+	digits := 15
+	if bitSize == 32 {
+		digits = 6
+	}
+
+	s := strconv.FormatFloat(f, 'e', -1, bitSize)
+	exp, _ := strconv.Atoi(s[strings.IndexByte(s, 'e')+1:])
+	if exp < -4 || exp >= digits {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', -1, bitSize)
+}
+
+// formatNumeric formats a numeric of the provided digits and exponent in plain
+// decimal notation, preserving its scale
+func formatNumeric(n *big.Int, exp int32) string {
+	digits := new(big.Int).Abs(n).String()
+	if exp >= 0 {
+		digits += strings.Repeat("0", int(exp))
+	} else {
+		scale := int(-exp)
+		if len(digits) <= scale {
+			digits = strings.Repeat("0", scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-scale] + "." + digits[len(digits)-scale:]
+	}
+
+	if n.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// formatInterval formats an interval in the postgres IntervalStyle, like
+// 1 year 2 mons 3 days 04:05:06.5
+func formatInterval(months, days int32, microseconds int64) string {
+	var b strings.Builder
+	zero, negative := true, false
+	part := func(value int64, unit string) {
+		if value == 0 {
+			return
+		}
+
+		if !zero {
+			b.WriteByte(' ')
+		}
+		if negative && value > 0 {
+			b.WriteByte('+')
+		}
+		b.WriteString(strconv.FormatInt(value, 10))
+		b.WriteString(" " + unit)
+		if value != 1 {
+			b.WriteByte('s')
+		}
+		zero, negative = false, value < 0
+	}
+
+	part(int64(months/12), "year")
+	part(int64(months%12), "mon")
+	part(int64(days), "day")
+	if !zero && microseconds == 0 {
+		return b.String()
+	}
+
+	if !zero {
+		b.WriteByte(' ')
+	}
+	if microseconds < 0 {
+		b.WriteByte('-')
+		microseconds = -microseconds
+	} else if negative {
+		b.WriteByte('+')
+	}
+
+	b.WriteString(formatClock(microseconds))
+	return b.String()
+}
@@ -0,0 +1,113 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEncodeText(t *testing.T) {
+	ci := newConnInfo()
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 600000000, time.FixedZone("", 2*60*60))
+
+	tests := []struct {
+		name     string
+		oid      pgtype.OID
+		value    driver.Value
+		expected string
+	}{
+		{"bool", pgtype.BoolOID, true, "t"},
+		{"bool from string", pgtype.BoolOID, "false", "f"},
+		{"bytea", pgtype.ByteaOID, []byte{0xde, 0xad}, `\xdead`},
+		{"char", pgtype.CharOID, int64('a'), "a"},
+		{"int8", pgtype.Int8OID, int64(-42), "-42"},
+		{"int2", pgtype.Int2OID, int64(7), "7"},
+		{"int4 from string", pgtype.Int4OID, "42", "42"},
+		{"text", pgtype.TextOID, "foo", "foo"},
+		{"text from bytes", pgtype.TextOID, []byte("foo"), "foo"},
+		{"empty text", pgtype.TextOID, "", ""},
+		{"json", pgtype.JSONOID, map[string]int{"a": 1}, `{"a":1}`},
+		{"float4", pgtype.Float4OID, float32(1.1), "1.1"},
+		{"float8", pgtype.Float8OID, 1.5, "1.5"},
+		{"float8 large", pgtype.Float8OID, 1e15, "1e+15"},
+		{"float8 small", pgtype.Float8OID, 0.00001, "1e-05"},
+		{"float8 infinity", pgtype.Float8OID, math.Inf(-1), "-Infinity"},
+		{"float8 nan", pgtype.Float8OID, math.NaN(), "NaN"},
+		{"varchar", pgtype.VarcharOID, "foo", "foo"},
+		{"date", pgtype.DateOID, ts, "2018-01-02"},
+		{"time", timeOID, ts, "03:04:05.6"},
+		{"timestamp", pgtype.TimestampOID, ts, "2018-01-02 03:04:05.6"},
+		{"timestamptz", pgtype.TimestamptzOID, ts, "2018-01-02 01:04:05.6+00"},
+		{"interval", 1186, 90 * time.Minute, "01:30:00"},
+		{"numeric", pgtype.NumericOID, "-1.50", "-1.50"},
+		{"numeric from float", pgtype.NumericOID, 0.05, "0.05"},
+		{"numeric from int", pgtype.NumericOID, int64(100), "100"},
+		{"jsonb", pgtype.JSONBOID, `{"a": 1}`, `{"a": 1}`},
+		{"unknown type", 0, int64(1), "1"},
+		{"mismatching value", pgtype.Int4OID, "foo", "foo"},
+		{"mismatching time", pgtype.TextOID, ts, "2018-01-02 01:04:05.6+00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := encodeText(ci, tt.oid, tt.value)
+			require.NoError(t, err)
+			require.NotNil(t, buf)
+			require.Equal(t, tt.expected, string(buf))
+		})
+	}
+
+	t.Run("null", func(t *testing.T) {
+		buf, err := encodeText(ci, pgtype.Int4OID, nil)
+		require.NoError(t, err)
+		require.Nil(t, buf)
+	})
+}
+
+func TestFormatInterval(t *testing.T) {
+	require.Equal(t, "00:00:00", formatInterval(0, 0, 0))
+	require.Equal(t, "1 year 2 mons 3 days 04:05:06.5", formatInterval(14, 3, 14706500000))
+	require.Equal(t, "1 mon", formatInterval(1, 0, 0))
+	require.Equal(t, "-1 days +01:00:00", formatInterval(0, -1, 3600000000))
+	require.Equal(t, "1 day -01:00:00", formatInterval(0, 1, -3600000000))
+	require.Equal(t, "25:00:00.000001", formatInterval(0, 0, 90000000001))
+}
+
+func TestEncodeBinary(t *testing.T) {
+	ci := newConnInfo()
+
+	t.Run("encodes by the column type", func(t *testing.T) {
+		buf, err := encodeBinary(ci, pgtype.Int4OID, int64(42))
+		require.NoError(t, err)
+		require.Equal(t, []byte{0, 0, 0, 42}, buf)
+	})
+	t.Run("time", func(t *testing.T) {
+		buf, err := encodeBinary(ci, timeOID, "00:00:01")
+		require.NoError(t, err)
+		require.Equal(t, []byte{0, 0, 0, 0, 0, 0x0f, 0x42, 0x40}, buf)
+	})
+	t.Run("text", func(t *testing.T) {
+		buf, err := encodeBinary(ci, pgtype.TextOID, int64(42))
+		require.NoError(t, err)
+		require.Equal(t, []byte("42"), buf)
+	})
+	t.Run("null", func(t *testing.T) {
+		buf, err := encodeBinary(ci, pgtype.Int4OID, nil)
+		require.NoError(t, err)
+		require.Nil(t, buf)
+	})
+	t.Run("fails on mismatching values", func(t *testing.T) {
+		_, err := encodeBinary(ci, pgtype.Int4OID, "foo")
+		require.Error(t, err)
+		require.Equal(t, "42804", fromErr(err).Code())
+	})
+	t.Run("fails on types without binary format", func(t *testing.T) {
+		_, err := encodeBinary(ci, 142, "<a/>")
+		require.Error(t, err)
+		require.Equal(t, "42883", fromErr(err).Code())
+		require.Equal(t, "no binary output function available for type xml", err.Error())
+	})
+}
@@ -0,0 +1,90 @@
+package pgsrv
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+)
+
+// enumValue is a value of an enum type. Both of its text and binary formats
+// are its label.
+type enumValue struct {
+	labels []string // the labels of the enum type
+	label  string
+	status pgtype.Status
+}
+
+func (dst *enumValue) Set(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		dst.label, dst.status = "", pgtype.Null
+		return nil
+	case string:
+		return dst.DecodeText(nil, []byte(value))
+	case []byte:
+		return dst.DecodeText(nil, value)
+	default:
+		return fmt.Errorf("cannot convert %v to enum", value)
+	}
+}
+
+func (dst *enumValue) Get() interface{} {
+	switch dst.status {
+	case pgtype.Present:
+		return dst.label
+	case pgtype.Null:
+		return nil
+	default:
+		return dst.status
+	}
+}
+
+func (src *enumValue) AssignTo(dst interface{}) error {
+	v, ok := dst.(*string)
+	if !ok || src.status != pgtype.Present {
+		return fmt.Errorf("cannot assign %v to %T", src, dst)
+	}
+	*v = src.label
+	return nil
+}
+
+func (dst *enumValue) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		dst.label, dst.status = "", pgtype.Null
+		return nil
+	}
+
+	for _, label := range dst.labels {
+		if label == string(src) {
+			dst.label, dst.status = label, pgtype.Present
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid input value for enum: \"%s\"", src)
+}
+
+func (dst *enumValue) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
+	return dst.DecodeText(ci, src)
+}
+
+func (src *enumValue) EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+	return append(buf, src.label...), nil
+}
+
+func (src *enumValue) EncodeBinary(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	return src.EncodeText(ci, buf)
+}
+
+// Value implements the database/sql/driver Valuer interface.
+func (src *enumValue) Value() (driver.Value, error) {
+	if src.status != pgtype.Present {
+		return nil, nil
+	}
+	return src.label, nil
+}
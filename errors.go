@@ -141,6 +141,128 @@ func InvalidSQLStatementName(stmtName string) Err {
 	return &err{M: msg, C: "26000", P: -1}
 }
 
+// InvalidCursorName indicates that a referred portal name is unknown/missing
+// to the server.
+func InvalidCursorName(portalName string) Err {
+	msg := fmt.Sprintf("portal \"%s\" does not exist", portalName)
+	return &err{M: msg, C: "34000", P: -1}
+}
+
+// ObjectNotInPrerequisiteState indicates that the referred object can't be
+// used in its current state, like re-running an already completed portal.
+func ObjectNotInPrerequisiteState(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "55000", P: -1}
+}
+
+// UndefinedParameter indicates that the query refers to a parameter ($n) that
+// wasn't declared or supplied.
+func UndefinedParameter(number int) Err {
+	msg := fmt.Sprintf("there is no parameter $%d", number)
+	return &err{M: msg, C: "42P02", P: -1}
+}
+
+// UndefinedType indicates that a referred data type is unknown to the server.
+func UndefinedType(typeName string) Err {
+	msg := fmt.Sprintf("type \"%s\" does not exist", typeName)
+	return &err{M: msg, C: "42704", P: -1}
+}
+
+// InvalidTextRepresentation indicates that a value in text format can't be
+// converted to its declared type.
+func InvalidTextRepresentation(typeName, value string) Err {
+	msg := fmt.Sprintf("invalid input syntax for type %s: \"%s\"", typeName, value)
+	return &err{M: msg, C: "22P02", P: -1}
+}
+
+// InvalidBinaryRepresentation indicates that a bind parameter in binary format
+// can't be converted to its declared type.
+func InvalidBinaryRepresentation(paramNumber int) Err {
+	msg := fmt.Sprintf("incorrect binary data format in bind parameter %d", paramNumber)
+	return &err{M: msg, C: "22P03", P: -1}
+}
+
+// DuplicateObject indicates that an object, like a data type, can't be created
+// as another object of the same name already exists.
+func DuplicateObject(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "42710", P: -1}
+}
+
+// UndefinedFunction indicates that a required function, like the binary
+// input or output function of a data type, doesn't exist.
+func UndefinedFunction(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "42883", P: -1}
+}
+
+// DatatypeMismatch indicates that a value doesn't match its declared type,
+// like a row value the backend returned for a column of another type.
+func DatatypeMismatch(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "42804", P: -1}
+}
+
+// NoActiveSQLTransaction indicates that a command that requires a transaction
+// block was issued outside of one.
+func NoActiveSQLTransaction(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "25P01", P: -1}
+}
+
+// ActiveSQLTransaction indicates that a command that can't run inside a
+// transaction block was issued within one.
+func ActiveSQLTransaction(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "25001", P: -1}
+}
+
+// InFailedSQLTransaction indicates that a command was issued within a failed
+// transaction block, before it was rolled back.
+func InFailedSQLTransaction() Err {
+	msg := "current transaction is aborted, commands ignored until end of transaction block"
+	return &err{M: msg, C: "25P02", P: -1}
+}
+
+// QueryCanceled indicates that the query was canceled by a cancel request.
+func QueryCanceled() Err {
+	return &err{M: "canceling statement due to user request", C: "57014", P: -1}
+}
+
+// StatementTimeout indicates that the query was canceled as it took longer than
+// the statement_timeout setting.
+func StatementTimeout() Err {
+	return &err{M: "canceling statement due to statement timeout", C: "57014", P: -1}
+}
+
+// IdleInTransactionSessionTimeout indicates that the session was terminated as
+// it was idle within a transaction block for longer than the
+// idle_in_transaction_session_timeout setting.
+func IdleInTransactionSessionTimeout() Err {
+	msg := "terminating connection due to idle-in-transaction timeout"
+	return &err{M: msg, C: "25P03", P: -1, S: fatalSeverity}
+}
+
+// InvalidParameterValue indicates that a setting was set to an invalid value.
+func InvalidParameterValue(name, value string) Err {
+	msg := fmt.Sprintf("invalid value for parameter \"%s\": \"%s\"", name, value)
+	return &err{M: msg, C: "22023", P: -1}
+}
+
+// InvalidAuthorizationSpecification indicates that the client isn't allowed to
+// connect, regardless of its credentials. It terminates the session.
+func InvalidAuthorizationSpecification(msg string, args ...interface{}) Err {
+	msg = fmt.Sprintf(msg, args...)
+	return &err{M: msg, C: "28000", P: -1, S: fatalSeverity}
+}
+
+// InvalidPassword indicates that the client failed to authenticate as the user,
+// whether the user exists or not. It terminates the session.
+func InvalidPassword(user string) Err {
+	msg := fmt.Sprintf("password authentication failed for user \"%s\"", user)
+	return &err{M: msg, C: "28P01", P: -1, S: fatalSeverity}
+}
+
 // ProtocolViolation indicates that a provided typed message has an invalid value
 func ProtocolViolation(msg string) Err {
 	return &err{M: msg, C: "08P01", P: -1}
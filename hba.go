@@ -0,0 +1,514 @@
+package pgsrv
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/panoplyio/pgsrv/protocol"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// HBA is a list of host-based authentication rules, in the format of
+// pg_hba.conf. Each rule matches connections by their type, database, user and
+// address, and determines their authentication method. The first rule that
+// matches a connection is used, and connections that no rule matches are
+// rejected.
+//
+// see: https://www.postgresql.org/docs/current/auth-pg-hba-conf.html
+type HBA struct {
+	rules []*hbaRule
+}
+
+// hbaRule is a single record of pg_hba.conf
+type hbaRule struct {
+	line      int
+	connType  string // local, host, hostssl, hostnossl, hostgssenc or hostnogssenc
+	databases []hbaToken
+	users     []hbaToken
+	address   string     // all, samehost or samenet, empty when ipNet is set
+	ipNet     *net.IPNet // matching addresses of host records
+	method    string
+	options   map[string]string
+}
+
+// hbaToken is a single item of a comma separated field. Quoted items never
+// match keywords, like all.
+type hbaToken struct {
+	value  string
+	quoted bool
+	regexp *regexp.Regexp // user names that start with a slash are regexps
+}
+
+// hbaMethods are the supported authentication methods
+var hbaMethods = map[string]bool{
+	"trust":         true,
+	"reject":        true,
+	"password":      true,
+	"md5":           true,
+	"scram-sha-256": true,
+	"cert":          true,
+}
+
+// ParseHBA parses the rules of a pg_hba.conf file. Blank lines and comments are
+// ignored, and lines that end with a backslash are continued on the next line.
+// The map option of cert rules names a user name map of pg_ident.conf (see
+// ParseIdent).
+// Including files (@file and include directives), hostname addresses and
+// authentication methods other than trust, reject, password, md5,
+// scram-sha-256 and cert aren't supported.
+func ParseHBA(r io.Reader) (*HBA, error) {
+	hba := &HBA{}
+	scanner := bufio.NewScanner(r)
+	line, start, continued := 0, 0, ""
+	for scanner.Scan() {
+		line++
+		if continued == "" {
+			start = line // continued records are reported by their first line
+		}
+		text := continued + scanner.Text()
+		if strings.HasSuffix(text, "\\") {
+			continued = strings.TrimSuffix(text, "\\")
+			continue
+		}
+		continued = ""
+
+		fields, err := tokenizeHBALine(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s in line %d of pg_hba.conf", err, start)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		rule, err := parseHBARule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s in line %d of pg_hba.conf", err, start)
+		}
+		rule.line = start
+		hba.rules = append(hba.rules, rule)
+	}
+	return hba, scanner.Err()
+}
+
+// tokenizeHBALine splits a line into its whitespace separated fields, each of
+// which is a comma separated list of tokens
+func tokenizeHBALine(line string) (fields [][]hbaToken, err error) {
+	var field []hbaToken
+	var token strings.Builder
+	quoted, inQuotes, inToken := false, false, false
+
+	endToken := func() {
+		if inToken {
+			field = append(field, hbaToken{value: token.String(), quoted: quoted})
+		}
+		token.Reset()
+		quoted, inToken = false, false
+	}
+	endField := func() {
+		endToken()
+		if len(field) > 0 {
+			fields = append(fields, field)
+		}
+		field = nil
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inQuotes && c == '"':
+			inQuotes = false
+		case inQuotes:
+			token.WriteByte(c)
+		case c == '"':
+			inQuotes, quoted, inToken = true, true, true
+		case c == '#':
+			i = len(line)
+		case c == ',':
+			endToken()
+		case c == ' ' || c == '\t' || c == '\r':
+			endField()
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	endField()
+	return fields, nil
+}
+
+// parseHBARule parses a record from the fields of its line
+func parseHBARule(fields [][]hbaToken) (*hbaRule, error) {
+	rule := &hbaRule{options: map[string]string{}}
+	next := func(name string) ([]hbaToken, error) {
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("end-of-line before %s specification", name)
+		}
+		field := fields[0]
+		fields = fields[1:]
+		return field, nil
+	}
+	single := func(name string) (string, error) {
+		field, err := next(name)
+		if err == nil && len(field) > 1 {
+			err = fmt.Errorf("multiple values specified for %s", name)
+		}
+		if err != nil {
+			return "", err
+		}
+		return field[0].value, nil
+	}
+
+	var err error
+	rule.connType, err = single("connection type")
+	if err != nil {
+		return nil, err
+	}
+	switch rule.connType {
+	case "local", "host", "hostssl", "hostnossl", "hostgssenc", "hostnogssenc":
+	default:
+		return nil, fmt.Errorf("invalid connection type \"%s\"", rule.connType)
+	}
+
+	rule.databases, err = next("database")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range rule.databases {
+		if strings.HasPrefix(t.value, "@") && !t.quoted {
+			return nil, fmt.Errorf("included files are not supported")
+		}
+	}
+
+	rule.users, err = next("role")
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range rule.users {
+		if strings.HasPrefix(t.value, "@") && !t.quoted {
+			return nil, fmt.Errorf("included files are not supported")
+		}
+		if strings.HasPrefix(t.value, "/") && !t.quoted {
+			rule.users[i].regexp, err = regexp.Compile(t.value[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression \"%s\": %s", t.value[1:], err)
+			}
+		}
+	}
+
+	if rule.connType != "local" {
+		address, err := single("IP address")
+		if err != nil {
+			return nil, err
+		}
+		fields, err = rule.parseAddress(address, fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rule.method, err = single("authentication method")
+	if err != nil {
+		return nil, err
+	}
+	if !hbaMethods[rule.method] {
+		return nil, fmt.Errorf("invalid authentication method \"%s\"", rule.method)
+	}
+	if rule.method == "cert" && rule.connType != "hostssl" {
+		return nil, fmt.Errorf("cert authentication is only supported on hostssl connections")
+	}
+
+	for _, field := range fields {
+		for _, t := range field {
+			parts := strings.SplitN(t.value, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("authentication option not in name=value format: %s", t.value)
+			}
+			err = rule.setOption(parts[0], parts[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rule, nil
+}
+
+// parseAddress parses the address of a host record, which is either a keyword,
+// an address in CIDR notation, or an address followed by a separate mask. It
+// returns the fields that follow the address.
+func (r *hbaRule) parseAddress(address string, fields [][]hbaToken) ([][]hbaToken, error) {
+	switch address {
+	case "all", "samehost", "samenet":
+		r.address = address
+		return fields, nil
+	}
+
+	if strings.Contains(address, "/") {
+		_, ipNet, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address \"%s\"", address)
+		}
+		r.ipNet = ipNet
+		return fields, nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("hostname addresses are not supported: \"%s\"", address)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("end-of-line before netmask specification")
+	}
+
+	mask := net.ParseIP(fields[0][0].value)
+	if mask == nil || (ip.To4() == nil) != (mask.To4() == nil) {
+		return nil, fmt.Errorf("invalid IP mask \"%s\"", fields[0][0].value)
+	}
+	if ip.To4() != nil {
+		ip, mask = ip.To4(), mask.To4()
+	}
+	r.ipNet = &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}
+	return fields[1:], nil
+}
+
+// setOption sets an authentication option of the record
+func (r *hbaRule) setOption(name, value string) error {
+	switch name {
+	case "clientcert":
+		if r.connType != "hostssl" {
+			return fmt.Errorf("clientcert can only be configured for \"hostssl\" rows")
+		}
+		if value != "verify-ca" && value != "verify-full" {
+			return fmt.Errorf("invalid value for clientcert: \"%s\"", value)
+		}
+		if r.method == "cert" && value != "verify-full" {
+			return fmt.Errorf("clientcert only accepts \"verify-full\" when using \"cert\" authentication")
+		}
+	case "map":
+		if r.method != "cert" {
+			return fmt.Errorf("authentication option \"map\" is only valid for authentication method cert")
+		}
+	default:
+		return fmt.Errorf("unrecognized authentication option name: \"%s\"", name)
+	}
+
+	r.options[name] = value
+	return nil
+}
+
+// matches determines if the record applies to the connection of the client
+func (r *hbaRule) matches(client *Client, user, database string) bool {
+	return r.matchesConnection(client) && r.matchesDatabase(database, user) && r.matchesUser(user)
+}
+
+func (r *hbaRule) matchesConnection(client *Client) bool {
+	local := client.RemoteAddr != nil && client.RemoteAddr.Network() == "unix"
+	switch {
+	case r.connType == "local":
+		return local
+	case local, r.connType == "hostgssenc": // GSSAPI encryption isn't supported
+		return false
+	case r.connType == "hostssl" && client.TLS == nil:
+		return false
+	case r.connType == "hostnossl" && client.TLS != nil:
+		return false
+	}
+
+	ip := remoteIP(client.RemoteAddr)
+	switch r.address {
+	case "all":
+		return true
+	case "samehost", "samenet":
+		return ip != nil && isLocalIP(ip, r.address == "samenet")
+	default:
+		return ip != nil && r.ipNet.Contains(ip)
+	}
+}
+
+func (r *hbaRule) matchesDatabase(database, user string) bool {
+	for _, t := range r.databases {
+		switch {
+		case t.quoted:
+			if t.value == database {
+				return true
+			}
+		case t.value == "all":
+			return true
+		case t.value == "sameuser", t.value == "samerole", t.value == "samegroup":
+			// there are no roles other than the users themselves
+			if database == user {
+				return true
+			}
+		case t.value == "replication":
+			// replication connections aren't supported
+		case t.value == database:
+			return true
+		}
+	}
+	return false
+}
+
+func (r *hbaRule) matchesUser(user string) bool {
+	for _, t := range r.users {
+		switch {
+		case t.quoted:
+			if t.value == user {
+				return true
+			}
+		case t.value == "all":
+			return true
+		case t.regexp != nil:
+			if t.regexp.MatchString(user) {
+				return true
+			}
+		case strings.HasPrefix(t.value, "+"):
+			// there are no roles other than the users themselves, which are
+			// members of their own roles
+			if t.value[1:] == user {
+				return true
+			}
+		case t.value == user:
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the remote address, or nil if it has none
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// isLocalIP determines if the IP address is one of the server's addresses, or
+// within one of the subnets it's directly connected to
+func isLocalIP(ip net.IP, subnet bool) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.Equal(ip) || (subnet && ipNet.Contains(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHBAAuthenticator creates an Authenticator that authenticates the clients
+// by the method of the first rule of hba that matches their connection. The
+// passwords of the password methods are provided by pp, which must be of the
+// same auth type. Just like Postgres, the md5 method also accepts SCRAMSHA256
+// providers, in which case the SCRAM-SHA-256 method is used instead. The user
+// name maps of cert rules are looked up in ident, which may be nil if there
+// are none.
+func NewHBAAuthenticator(hba *HBA, ident *Ident, pp PasswordProvider) (Authenticator, error) {
+	a := &hbaAuthenticator{hba: hba, authenticators: map[*hbaRule]Authenticator{}}
+
+	var authType AuthType
+	if pp != nil {
+		authType = pp.Type()
+	}
+	scram := newSCRAMAuthenticator(pp)
+	for _, r := range hba.rules {
+		switch {
+		case r.method == "reject":
+		case r.method == "trust":
+			a.authenticators[r] = &noPasswordAuthenticator{}
+		case r.method == "cert":
+			mapName, ok := r.options["map"]
+			if ok && !ident.hasMap(mapName) {
+				return nil, fmt.Errorf("user name map \"%s\" in line %d of pg_hba.conf is not defined", mapName, r.line)
+			}
+			a.authenticators[r] = &certAuthenticator{ident: ident, mapName: mapName}
+		case r.method == "password" && authType == Plain:
+			a.authenticators[r] = &clearTextAuthenticator{pp}
+		case r.method == "md5" && authType == MD5:
+			a.authenticators[r] = &md5Authenticator{pp}
+		case r.method == "md5" && authType == SCRAMSHA256, r.method == "scram-sha-256" && authType == SCRAMSHA256:
+			a.authenticators[r] = scram
+		default:
+			return nil, fmt.Errorf("%s authentication in line %d of pg_hba.conf requires a password provider of a matching type", r.method, r.line)
+		}
+	}
+	return a, nil
+}
+
+// hbaAuthenticator authenticates the clients by the rules of an HBA
+type hbaAuthenticator struct {
+	hba            *HBA
+	authenticators map[*hbaRule]Authenticator // by the rules that use them
+}
+
+func (a *hbaAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
+	fail := func(err error) error {
+		rw.Write(protocol.ErrorResponse(err))
+		return err
+	}
+
+	// the database defaults to the user name, just like in Postgres
+	user, _ := client.Args["user"].(string)
+	database, _ := client.Args["database"].(string)
+	if database == "" {
+		database = user
+	}
+
+	for _, r := range a.hba.rules {
+		if !r.matches(client, user, database) {
+			continue
+		}
+
+		if r.method == "reject" {
+			return fail(InvalidAuthorizationSpecification(
+				"pg_hba.conf rejects connection for %s", describeConnection(client, user, database)))
+		}
+		if mode, ok := r.options["clientcert"]; ok {
+			err := (&certAuthenticator{}).verify(client, user, mode == "verify-full")
+			if err != nil {
+				return fail(err)
+			}
+		}
+		return a.authenticators[r].Authenticate(rw, client)
+	}
+
+	return fail(InvalidAuthorizationSpecification(
+		"no pg_hba.conf entry for %s", describeConnection(client, user, database)))
+}
+
+// describeConnection describes the connection of the client for the errors of
+// rejected connections, like: host "::1", user "postgres", database "db", no
+// encryption
+func describeConnection(client *Client, user, database string) string {
+	host := "[local]"
+	if client.RemoteAddr == nil || client.RemoteAddr.Network() != "unix" {
+		host = "[unknown]"
+		if ip := remoteIP(client.RemoteAddr); ip != nil {
+			host = ip.String()
+		}
+	}
+
+	encryption := "no encryption"
+	if client.TLS != nil {
+		encryption = "SSL encryption"
+	}
+	return fmt.Sprintf("host \"%s\", user \"%s\", database \"%s\", %s", host, user, database, encryption)
+}
@@ -0,0 +1,190 @@
+package pgsrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+)
+
+const testHBA = `
+# TYPE  DATABASE        USER            ADDRESS                 METHOD
+local   all             all                                     trust
+host    "all",db1       admin,"b c"     10.0.0.0/8              trust
+host    sameuser        /^app_          192.168.1.0 255.255.255.0 md5
+hostssl all             all             ::1/128                 cert
+hostnossl all           +ops            0.0.0.0/0 \
+                                                                reject
+host    all             all             0.0.0.0/0               md5 # the rest
+`
+
+func TestParseHBA(t *testing.T) {
+	hba, err := ParseHBA(strings.NewReader(testHBA))
+	require.NoError(t, err)
+	require.Len(t, hba.rules, 6)
+
+	r := hba.rules[1]
+	require.Equal(t, 4, r.line)
+	require.Equal(t, "host", r.connType)
+	require.Equal(t, []hbaToken{{value: "all", quoted: true}, {value: "db1"}}, r.databases)
+	require.Equal(t, []hbaToken{{value: "admin"}, {value: "b c", quoted: true}}, r.users)
+	require.Equal(t, "10.0.0.0/8", r.ipNet.String())
+	require.Equal(t, "trust", r.method)
+
+	require.Equal(t, "192.168.1.0/24", hba.rules[2].ipNet.String())
+	require.NotNil(t, hba.rules[2].users[0].regexp)
+	require.Equal(t, "md5", hba.rules[2].method)
+	require.Equal(t, "reject", hba.rules[4].method)
+	require.Equal(t, 7, hba.rules[4].line)
+
+	t.Run("fails on invalid rules", func(t *testing.T) {
+		for line, expected := range map[string]string{
+			"hots all all 0.0.0.0/0 trust":                  "invalid connection type \"hots\" in line 1 of pg_hba.conf",
+			"host all all":                                  "end-of-line before IP address specification in line 1 of pg_hba.conf",
+			"host all all 0.0.0.0/0 ident":                  "invalid authentication method \"ident\" in line 1 of pg_hba.conf",
+			"host all all 10.0.0.1 trust":                   "invalid IP mask \"trust\" in line 1 of pg_hba.conf",
+			"host all all example.com trust":                "hostname addresses are not supported: \"example.com\" in line 1 of pg_hba.conf",
+			"host all all all cert":                         "cert authentication is only supported on hostssl connections in line 1 of pg_hba.conf",
+			"host all all all md5 foo=bar":                  "unrecognized authentication option name: \"foo\" in line 1 of pg_hba.conf",
+			"hostssl all all all cert clientcert=verify-ca": "clientcert only accepts \"verify-full\" when using \"cert\" authentication in line 1 of pg_hba.conf",
+			"host all all all md5 map=certmap":              "authentication option \"map\" is only valid for authentication method cert in line 1 of pg_hba.conf",
+			"host @dbs all all trust":                       "included files are not supported in line 1 of pg_hba.conf",
+			"host all \"all all trust":                      "unterminated quoted string in line 1 of pg_hba.conf",
+			"host all all all trust,md5":                    "multiple values specified for authentication method in line 1 of pg_hba.conf",
+		} {
+			_, err := ParseHBA(strings.NewReader(line))
+			require.EqualError(t, err, expected)
+		}
+	})
+}
+
+func TestHBARule_matches(t *testing.T) {
+	hba, err := ParseHBA(strings.NewReader(testHBA))
+	require.NoError(t, err)
+
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 5432} }
+	unix := &net.UnixAddr{Name: "/tmp/.s.PGSQL.5432", Net: "unix"}
+	tlsState := &tls.ConnectionState{}
+
+	for _, tt := range []struct {
+		addr     net.Addr
+		tls      *tls.ConnectionState
+		user     string
+		database string
+		expected int // the index of the first matching rule, -1 if none
+	}{
+		{unix, nil, "anyone", "any", 0},
+		{tcp("10.1.2.3"), nil, "admin", "db1", 1},
+		{tcp("10.1.2.3"), nil, "b c", "all", 1},
+		{tcp("10.1.2.3"), nil, "admin", "db2", 5},
+		{tcp("192.168.1.7"), nil, "app_1", "app_1", 2},
+		{tcp("192.168.1.7"), nil, "app_1", "db", 5},
+		{tcp("192.168.2.7"), nil, "app_1", "app_1", 5},
+		{tcp("::1"), tlsState, "user", "db", 3},
+		{tcp("::1"), nil, "user", "db", -1},
+		{tcp("1.2.3.4"), nil, "ops", "db", 4},
+		{tcp("1.2.3.4"), tlsState, "ops", "db", 5},
+	} {
+		client := &Client{RemoteAddr: tt.addr, TLS: tt.tls}
+		matched := -1
+		for i, r := range hba.rules {
+			if r.matches(client, tt.user, tt.database) {
+				matched = i
+				break
+			}
+		}
+		require.Equal(t, tt.expected, matched, "%s %s@%s", tt.addr, tt.user, tt.database)
+	}
+}
+
+func TestHBAAuthenticator_Authenticate(t *testing.T) {
+	hba, err := ParseHBA(strings.NewReader(testHBA))
+	require.NoError(t, err)
+
+	_, err = NewHBAAuthenticator(hba, nil, nil)
+	require.EqualError(t, err, "md5 authentication in line 5 of pg_hba.conf requires a password provider of a matching type")
+
+	certHBA, err := ParseHBA(strings.NewReader("hostssl all all all cert map=certmap"))
+	require.NoError(t, err)
+	_, err = NewHBAAuthenticator(certHBA, nil, nil)
+	require.EqualError(t, err, "user name map \"certmap\" in line 1 of pg_hba.conf is not defined")
+
+	a, err := NewHBAAuthenticator(hba, nil, &md5ConstantPasswordProvider{password: []byte("test")})
+	require.NoError(t, err)
+
+	t.Run("trust", func(t *testing.T) {
+		rw := &mockMessageReadWriter{}
+		err := a.Authenticate(rw, &Client{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1")},
+			Args:       map[string]interface{}{"user": "admin", "database": "db1"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, []protocol.Message{authOKMessage}, rw.messages)
+	})
+	t.Run("md5", func(t *testing.T) {
+		rw := &mockMD5MessageReadWriter{user: "app_1", pass: []byte("test")}
+		err := a.Authenticate(rw, &Client{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.1")},
+			Args:       map[string]interface{}{"user": "app_1"},
+		})
+		require.NoError(t, err)
+		require.Equal(t, authOKMessage, rw.messages[1])
+	})
+	t.Run("reject", func(t *testing.T) {
+		rw := &mockMessageReadWriter{}
+		err := a.Authenticate(rw, &Client{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("1.2.3.4")},
+			Args:       map[string]interface{}{"user": "ops", "database": "db"},
+		})
+		require.EqualError(t, err, "pg_hba.conf rejects connection for host \"1.2.3.4\", user \"ops\", database \"db\", no encryption")
+		require.Equal(t, "28000", fromErr(err).Code())
+		require.Equal(t, "FATAL", fromErr(err).Severity())
+		require.Len(t, rw.messages, 1)
+	})
+	t.Run("no entry", func(t *testing.T) {
+		rw := &mockMessageReadWriter{}
+		err := a.Authenticate(rw, &Client{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("::1")},
+			Args:       map[string]interface{}{"user": "u", "database": "db"},
+		})
+		require.EqualError(t, err, "no pg_hba.conf entry for host \"::1\", user \"u\", database \"db\", no encryption")
+		require.Equal(t, "28000", fromErr(err).Code())
+		require.True(t, rw.messages[0].IsError())
+	})
+	t.Run("cert", func(t *testing.T) {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "u"}}
+		client := &Client{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("::1")},
+			TLS:        &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+			Args:       map[string]interface{}{"user": "u"},
+		}
+
+		rw := &mockMessageReadWriter{}
+		require.NoError(t, a.Authenticate(rw, client))
+		require.Equal(t, []protocol.Message{authOKMessage}, rw.messages)
+
+		client.Args["user"] = "v"
+		err := a.Authenticate(rw, client)
+		require.EqualError(t, err, "certificate authentication failed for user \"v\"")
+
+		// subject alternative names only identify users through user name maps
+		cert.DNSNames = []string{"v", "svc.example.com"}
+		err = a.Authenticate(rw, client)
+		require.EqualError(t, err, "certificate authentication failed for user \"v\"")
+
+		ident, err := ParseIdent(strings.NewReader(testIdent))
+		require.NoError(t, err)
+		mapped := &certAuthenticator{ident: ident, mapName: "certmap"}
+		require.Error(t, mapped.Authenticate(rw, client))
+		client.Args["user"] = "svc"
+		require.NoError(t, mapped.Authenticate(rw, client))
+
+		client.TLS = &tls.ConnectionState{}
+		err = a.Authenticate(rw, client)
+		require.EqualError(t, err, "connection requires a valid client certificate")
+	})
+}
@@ -0,0 +1,117 @@
+package pgsrv
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Ident is a list of user name maps, in the format of pg_ident.conf. Each map
+// allows the identities that clients are authenticated by, like the names on
+// their certificates, to connect as certain users.
+//
+// see: https://www.postgresql.org/docs/current/auth-username-maps.html
+type Ident struct {
+	entries []*identEntry
+}
+
+// identEntry is a single record of pg_ident.conf
+type identEntry struct {
+	mapName    string
+	systemUser hbaToken // system user names that start with a slash are regexps
+	user       hbaToken
+}
+
+// ParseIdent parses the user name maps of a pg_ident.conf file. Blank lines and
+// comments are ignored. System user names that start with a slash are regular
+// expressions, whose first parenthesized subexpression replaces \1 in the user
+// name. The user name all matches any user.
+func ParseIdent(r io.Reader) (*Ident, error) {
+	ident := &Ident{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields, err := tokenizeHBALine(scanner.Text())
+		if err == nil && len(fields) != 0 && len(fields) != 3 {
+			err = fmt.Errorf("invalid number of fields")
+		}
+		for _, field := range fields {
+			if err == nil && len(field) > 1 {
+				err = fmt.Errorf("multiple values in ident field")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s in line %d of pg_ident.conf", err, line)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		entry := &identEntry{mapName: fields[0][0].value, systemUser: fields[1][0], user: fields[2][0]}
+		if strings.HasPrefix(entry.systemUser.value, "/") && !entry.systemUser.quoted {
+			entry.systemUser.regexp, err = regexp.Compile(entry.systemUser.value[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression \"%s\" in line %d of pg_ident.conf: %s", entry.systemUser.value[1:], line, err)
+			}
+		}
+		ident.entries = append(ident.entries, entry)
+	}
+	return ident, scanner.Err()
+}
+
+// Maps determines if the named map allows the system user to connect as the
+// user
+func (i *Ident) Maps(mapName, systemUser, user string) bool {
+	if i == nil {
+		return false
+	}
+
+	for _, e := range i.entries {
+		if e.mapName == mapName && e.maps(systemUser, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMap determines if a map of the provided name is defined
+func (i *Ident) hasMap(mapName string) bool {
+	if i == nil {
+		return false
+	}
+
+	for _, e := range i.entries {
+		if e.mapName == mapName {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *identEntry) maps(systemUser, user string) bool {
+	var match []string
+	if e.systemUser.regexp != nil {
+		match = e.systemUser.regexp.FindStringSubmatch(systemUser)
+		if match == nil {
+			return false
+		}
+	} else if e.systemUser.value != systemUser {
+		return false
+	}
+
+	// the keywords are only those written in pg_ident.conf, never the names
+	// substituted into them
+	expected := e.user.value
+	if expected == "all" && !e.user.quoted {
+		return true
+	}
+	if strings.HasPrefix(expected, "+") && !e.user.quoted {
+		// there are no roles other than the users themselves
+		expected = expected[1:]
+	}
+	if len(match) > 1 {
+		expected = strings.Replace(expected, `\1`, match[1], 1)
+	}
+	return expected == user
+}
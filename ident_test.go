@@ -0,0 +1,63 @@
+package pgsrv
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+const testIdent = `
+# MAPNAME       SYSTEM-USERNAME         PG-USERNAME
+certmap         svc.example.com         svc
+certmap         /^(.*)@example\.com$    \1
+certmap         admin                   all
+certmap         /^cn=(.*)$              \1
+other           "/literal"              lit
+`
+
+func TestParseIdent(t *testing.T) {
+	ident, err := ParseIdent(strings.NewReader(testIdent))
+	require.NoError(t, err)
+	require.Len(t, ident.entries, 5)
+	require.NotNil(t, ident.entries[1].systemUser.regexp)
+	require.Nil(t, ident.entries[4].systemUser.regexp)
+
+	for text, expected := range map[string]string{
+		"certmap a":     "invalid number of fields in line 1 of pg_ident.conf",
+		"certmap a,b c": "multiple values in ident field in line 1 of pg_ident.conf",
+		"certmap /(a b": "invalid regular expression \"(a\" in line 1 of pg_ident.conf: error parsing regexp: missing closing ): `(a`",
+		"certmap \"a b": "unterminated quoted string in line 1 of pg_ident.conf",
+	} {
+		_, err := ParseIdent(strings.NewReader(text))
+		require.EqualError(t, err, expected)
+	}
+}
+
+func TestIdent_Maps(t *testing.T) {
+	ident, err := ParseIdent(strings.NewReader(testIdent))
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		mapName, systemUser, user string
+		expected                  bool
+	}{
+		{"certmap", "svc.example.com", "svc", true},
+		{"certmap", "svc.example.com", "other", false},
+		{"certmap", "bob@example.com", "bob", true},
+		{"certmap", "bob@example.com", "alice", false},
+		{"certmap", "bob@example.org", "bob", false},
+		{"certmap", "admin", "anyone", true},
+		{"certmap", "cn=bob", "bob", true},
+		{"certmap", "cn=all", "postgres", false},
+		{"certmap", "cn=all", "all", true},
+		{"certmap", "cn=+x", "x", false},
+		{"certmap", "cn=+x", "+x", true},
+		{"other", "/literal", "lit", true},
+		{"other", "svc.example.com", "svc", false},
+		{"undefined", "svc.example.com", "svc", false},
+	} {
+		require.Equal(t, tt.expected, ident.Maps(tt.mapName, tt.systemUser, tt.user), "%+v", tt)
+	}
+
+	require.False(t, (*Ident)(nil).Maps("certmap", "admin", "admin"))
+}
@@ -0,0 +1,150 @@
+package pgsrv
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// paramTypes resolves the types of all of the parameters referenced by the
+// statement. Types specified by the client are used as is, while unspecified
+// ones (OID 0, or parameters the client didn't provide a type for) are resolved
+// by the backend's ParameterDescriber, or inferred from the context they're
+// used in, like casts ($1::int4) and comparisons with typed literals ($1 = 5).
+// Parameters that can't be resolved fall back to text.
+func (s *session) paramTypes(ctx context.Context, stmt nodes.Node, oids []uint32) ([]nodes.Node, error) {
+	count := len(oids)
+	inferred := map[int]string{}
+	walk(stmt, func(n nodes.Node) {
+		switch v := n.(type) {
+		case nodes.ParamRef:
+			if v.Number > count {
+				count = v.Number
+			}
+		case nodes.TypeCast:
+			// explicit casts take precedence over other inferred types
+			if ref, ok := v.Arg.(nodes.ParamRef); ok && v.TypeName != nil {
+				inferred[ref.Number] = typeNameString(*v.TypeName)
+			}
+		case nodes.A_Expr:
+			inferOperand(inferred, v.Lexpr, v.Rexpr)
+			inferOperand(inferred, v.Rexpr, v.Lexpr)
+		}
+	})
+
+	var described []string
+	types := make([]nodes.Node, count)
+	for i := range types {
+		var dt *pgtype.DataType
+		if i < len(oids) && oids[i] != 0 {
+			var ok bool
+			dt, ok = s.ConnInfo.DataTypeForOID(pgtype.OID(oids[i]))
+			if !ok {
+				return nil, fmt.Errorf("cache lookup failed for type %d", oids[i])
+			}
+		} else {
+			// only ask the backend once, and only if there are unspecified types
+			if described == nil {
+				var err error
+				described, err = s.describeParams(ctx, stmt, count)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			name := described[i]
+			if name == "" {
+				name = inferred[i+1]
+			}
+			dt = dataTypeForName(s.ConnInfo, name)
+		}
+
+		types[i] = nodes.TypeName{
+			TypeOid: nodes.Oid(dt.OID),
+			Names:   nodes.List{Items: []nodes.Node{nodes.String{Str: dt.Name}}},
+		}
+	}
+	return types, nil
+}
+
+// describeParams asks the backend for the types of the statement's parameters,
+// if it implements ParameterDescriber. Within a transaction block, the Tx is
+// asked when it implements it. Unknown types are left empty.
+func (s *session) describeParams(ctx context.Context, stmt nodes.Node, count int) ([]string, error) {
+	names := make([]string, count)
+	describer, ok := s.tx.(ParameterDescriber)
+	if !ok {
+		describer, ok = s.Server.queryer.(ParameterDescriber)
+	}
+	if !ok || stmt == nil {
+		return names, nil
+	}
+
+	described, err := describer.DescribeParameters(ctx, unwrapStmt(stmt))
+	if err != nil {
+		return nil, err
+	}
+	copy(names, described)
+	return names, nil
+}
+
+// dataTypeForName looks up a data type by its name, falling back to text for
+// unknown types
+func dataTypeForName(ci *pgtype.ConnInfo, name string) *pgtype.DataType {
+	dt, ok := ci.DataTypeForName(canonicalTypeName(name))
+	if !ok {
+		dt, _ = ci.DataTypeForName("text")
+	}
+	return dt
+}
+
+// inferOperand infers the type of a parameter operand from the other operand
+// of the same expression, when it's a typed literal
+func inferOperand(inferred map[int]string, operand, other nodes.Node) {
+	ref, ok := operand.(nodes.ParamRef)
+	if !ok {
+		return
+	}
+
+	if _, exists := inferred[ref.Number]; exists {
+		return
+	}
+
+	if name := literalType(other); name != "" {
+		inferred[ref.Number] = name
+	}
+}
+
+// literalType returns the type name of a literal, like 5, 1.5 or 'x'::date.
+// Untyped string literals are of unknown type, and an empty name is returned.
+func literalType(n nodes.Node) string {
+	switch v := n.(type) {
+	case nodes.A_Const:
+		switch v.Val.(type) {
+		case nodes.Integer:
+			return "int4"
+		case nodes.Float:
+			return "numeric"
+		}
+	case nodes.TypeCast:
+		if _, ok := v.Arg.(nodes.A_Const); ok && v.TypeName != nil {
+			return typeNameString(*v.TypeName)
+		}
+	}
+	return ""
+}
+
+// typeNameString returns the name of the type, without its schema. Array types
+// are named by their element type followed by [], like int4[].
+func typeNameString(typ nodes.TypeName) string {
+	if len(typ.Names.Items) == 0 {
+		return ""
+	}
+
+	name, _ := typ.Names.Items[len(typ.Names.Items)-1].(nodes.String)
+	if len(typ.ArrayBounds.Items) > 0 {
+		return name.Str + "[]"
+	}
+	return name.Str
+}
@@ -0,0 +1,76 @@
+package pgsrv
+
+import (
+	"context"
+	parser "github.com/lfittl/pg_query_go"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// mockParameterDescriber describes the parameters as the provided types
+type mockParameterDescriber struct {
+	mockQueryer
+	types []string
+}
+
+func (r *mockParameterDescriber) DescribeParameters(ctx context.Context, n nodes.Node) ([]string, error) {
+	return r.types, nil
+}
+
+func TestSession_paramTypes(t *testing.T) {
+	sess := &session{
+		ConnInfo: newConnInfo(),
+		Server:   &server{queryer: &mockQueryer{}},
+	}
+
+	paramTypes := func(t *testing.T, query string, oids ...uint32) []nodes.Node {
+		tree, err := parser.Parse(query)
+		require.NoError(t, err)
+		types, err := sess.paramTypes(context.Background(), tree.Statements[0], oids)
+		require.NoError(t, err)
+		return types
+	}
+
+	t.Run("specified types", func(t *testing.T) {
+		types := paramTypes(t, "SELECT $1", 23)
+		require.Equal(t, []nodes.Node{typeName(23, "int4")}, types)
+	})
+	t.Run("falls back to text", func(t *testing.T) {
+		types := paramTypes(t, "SELECT $1", 0)
+		require.Equal(t, []nodes.Node{typeName(25, "text")}, types)
+	})
+	t.Run("counts unspecified parameters", func(t *testing.T) {
+		types := paramTypes(t, "SELECT $1, $3", 23)
+		require.Equal(t, []nodes.Node{
+			typeName(23, "int4"),
+			typeName(25, "text"),
+			typeName(25, "text"),
+		}, types)
+	})
+	t.Run("infers casts", func(t *testing.T) {
+		types := paramTypes(t, "SELECT $1::int4, $2::pg_catalog.bool")
+		require.Equal(t, []nodes.Node{typeName(23, "int4"), typeName(16, "bool")}, types)
+	})
+	t.Run("infers comparisons with literals", func(t *testing.T) {
+		types := paramTypes(t, "SELECT * FROM t WHERE a = 5 AND 1.5 < $2 AND $1 = '2018-01-01'::date")
+		require.Equal(t, []nodes.Node{typeName(1082, "date"), typeName(1700, "numeric")}, types)
+	})
+	t.Run("untyped literals are unknown", func(t *testing.T) {
+		types := paramTypes(t, "SELECT * FROM t WHERE $1 = 'foo'")
+		require.Equal(t, []nodes.Node{typeName(25, "text")}, types)
+	})
+	t.Run("backend describes parameters", func(t *testing.T) {
+		sess.Server.queryer = &mockParameterDescriber{types: []string{"", "int8"}}
+		defer func() { sess.Server.queryer = &mockQueryer{} }()
+
+		types := paramTypes(t, "SELECT $1::bool, $2::int4", 0, 0)
+		require.Equal(t, []nodes.Node{typeName(16, "bool"), typeName(20, "int8")}, types)
+	})
+	t.Run("fails on unknown types", func(t *testing.T) {
+		tree, err := parser.Parse("SELECT $1")
+		require.NoError(t, err)
+		_, err = sess.paramTypes(context.Background(), tree.Statements[0], []uint32{1})
+		require.Error(t, err)
+	})
+}
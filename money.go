@@ -0,0 +1,142 @@
+package pgsrv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// moneyOID is the OID of the money data type
+const moneyOID pgtype.OID = 790
+
+// pgMoney is the money data type, which pgtype doesn't implement. It's an
+// amount of cents, formatted like the C locale of lc_monetary does, like
+// $1,234.56.
+type pgMoney struct {
+	Cents  int64
+	Status pgtype.Status
+}
+
+func (dst *pgMoney) Set(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*dst = pgMoney{Status: pgtype.Null}
+	case int64:
+		*dst = pgMoney{Cents: value * 100, Status: pgtype.Present}
+	case float64:
+		*dst = pgMoney{Cents: int64(math.Round(value * 100)), Status: pgtype.Present}
+	case string:
+		return dst.DecodeText(nil, []byte(value))
+	case []byte:
+		return dst.DecodeText(nil, value)
+	default:
+		return fmt.Errorf("cannot convert %v to money", value)
+	}
+	return nil
+}
+
+func (dst *pgMoney) Get() interface{} {
+	switch dst.Status {
+	case pgtype.Present:
+		return string(formatMoney(dst.Cents))
+	case pgtype.Null:
+		return nil
+	default:
+		return dst.Status
+	}
+}
+
+func (src *pgMoney) AssignTo(dst interface{}) error {
+	if src.Status != pgtype.Present {
+		return fmt.Errorf("cannot assign %v to %T", src, dst)
+	}
+
+	switch v := dst.(type) {
+	case *int64:
+		*v = src.Cents
+	case *string:
+		*v = formatMoney(src.Cents)
+	default:
+		return fmt.Errorf("cannot assign %v to %T", src, dst)
+	}
+	return nil
+}
+
+func (dst *pgMoney) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		*dst = pgMoney{Status: pgtype.Null}
+		return nil
+	}
+
+	s := strings.TrimSpace(string(src))
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "$")
+	s = strings.Replace(s, ",", "", -1)
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || strings.ContainsAny(s, "eE") {
+		return fmt.Errorf("invalid input syntax for type money: \"%s\"", src)
+	}
+
+	cents := int64(math.Round(f * 100))
+	if negative {
+		cents = -cents
+	}
+	*dst = pgMoney{Cents: cents, Status: pgtype.Present}
+	return nil
+}
+
+func (dst *pgMoney) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		*dst = pgMoney{Status: pgtype.Null}
+		return nil
+	}
+
+	if len(src) != 8 {
+		return fmt.Errorf("invalid length for money: %v", len(src))
+	}
+	*dst = pgMoney{Cents: int64(binary.BigEndian.Uint64(src)), Status: pgtype.Present}
+	return nil
+}
+
+func (src *pgMoney) EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.Status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+	return append(buf, formatMoney(src.Cents)...), nil
+}
+
+func (src *pgMoney) EncodeBinary(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.Status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(src.Cents))
+	return append(buf, b...), nil
+}
+
+// formatMoney formats an amount of cents with a currency symbol and thousands
+// separators, like -$1,234.56
+func formatMoney(cents int64) string {
+	sign := ""
+	abs := uint64(cents)
+	if cents < 0 {
+		sign, abs = "-", uint64(-cents)
+	}
+
+	units := strconv.FormatUint(abs/100, 10)
+	for i := len(units) - 3; i > 0; i -= 3 {
+		units = units[:i] + "," + units[i:]
+	}
+	return fmt.Sprintf("%s$%s.%02d", sign, units, abs%100)
+}
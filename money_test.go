@@ -0,0 +1,29 @@
+package pgsrv
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestFormatMoney(t *testing.T) {
+	require.Equal(t, "$0.00", formatMoney(0))
+	require.Equal(t, "$1,234.56", formatMoney(123456))
+	require.Equal(t, "-$1,234,567.05", formatMoney(-123456705))
+}
+
+func TestPgMoney(t *testing.T) {
+	v := &pgMoney{}
+	require.NoError(t, v.DecodeText(nil, []byte("-$1,234.56")))
+	require.Equal(t, int64(-123456), v.Cents)
+
+	require.NoError(t, v.Set(12.5))
+	buf, err := v.EncodeText(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "$12.50", string(buf))
+
+	buf, err = v.EncodeBinary(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 0, 0, 0, 4, 226}, buf)
+
+	require.Error(t, v.DecodeText(nil, []byte("foo")))
+}
@@ -2,8 +2,10 @@ package pgsrv
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql/driver"
 	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
 	"net"
 )
 
@@ -21,6 +23,74 @@ type Execer interface {
 	Exec(ctx context.Context, n nodes.Node) (driver.Result, error)
 }
 
+// QueryerWithArgs can be implemented by a Queryer that prefers to receive the
+// parameters of prepared statements separately, the same way database/sql
+// drivers do. The provided node keeps its parameter placeholders ($1, $2, etc.)
+// and the args are decoded from the client's Bind message. Queryers that don't
+// implement it receive the node with the parameters already bound into it as
+// typed constants.
+type QueryerWithArgs interface {
+	QueryArgs(ctx context.Context, n nodes.Node, args []driver.NamedValue) (driver.Rows, error)
+}
+
+// ExecerWithArgs is the equivalent of QueryerWithArgs for Execer.
+type ExecerWithArgs interface {
+	ExecArgs(ctx context.Context, n nodes.Node, args []driver.NamedValue) (driver.Result, error)
+}
+
+// Describer can be implemented by a Queryer to describe the rows a query would
+// return, without executing it. It's required for answering Describe messages
+// of prepared statements, which many drivers use to learn the result schema
+// ahead of execution. The returned Rows are only used for their metadata
+// (Columns and the optional driver.RowsColumnType* interfaces) and are closed
+// without being read. Returning nil Rows indicates that no rows are returned.
+type Describer interface {
+	Describe(ctx context.Context, n nodes.Node) (driver.Rows, error)
+}
+
+// RowsColumnSource can be implemented by driver.Rows, alongside the optional
+// driver.RowsColumnType* interfaces, to report the table and column each of
+// the columns originates from. The OID of the table and the attribute number
+// of the column are reported to the frontend, which some drivers use to map
+// results back to their tables. ok is false for columns that aren't simple
+// references to a table column, like expressions.
+type RowsColumnSource interface {
+	driver.Rows
+	ColumnSource(index int) (tableOid uint32, attrNum int16, ok bool)
+}
+
+// ParameterDescriber can be implemented by a Queryer to resolve the types of
+// prepared statement parameters that the client left unspecified (OID 0), as
+// many drivers do. It returns the type names of the parameters, ordered by
+// their number ($1 first). Empty names are left to be inferred from the
+// statement itself, falling back to text.
+type ParameterDescriber interface {
+	DescribeParameters(ctx context.Context, n nodes.Node) ([]string, error)
+}
+
+// Transactor can be implemented by a Queryer to handle transaction blocks
+// itself, rather than receiving BEGIN, COMMIT, etc. as commands to execute.
+// Begin is called on BEGIN (or START TRANSACTION), and the returned Tx handles
+// the rest of the transaction block.
+type Transactor interface {
+	Begin(ctx context.Context) (Tx, error)
+}
+
+// Tx is a transaction block begun by a Transactor. All of the queries issued
+// within the block are routed to it, rather than to the server's Queryer. It
+// may also implement Execer, QueryerWithArgs and ExecerWithArgs, just like the
+// Queryer, as well as Describer and ParameterDescriber, which otherwise are
+// left to the Queryer. The transaction block ends once Commit or Rollback is
+// called, even if they fail.
+type Tx interface {
+	Queryer
+	Commit(ctx context.Context) error
+	Rollback(ctx context.Context) error
+	Savepoint(ctx context.Context, name string) error
+	RollbackTo(ctx context.Context, name string) error
+	Release(ctx context.Context, name string) error
+}
+
 // ResultTag can be implemented by driver.Result to provide the tag name to be
 // used to notify the postgres client of the completed command. If left
 // unimplemented, the default behavior follows the spec described in the link
@@ -44,6 +114,24 @@ type Session interface {
 	All() map[string]interface{}
 }
 
+// Authenticator authenticates the client at the very beginning of every
+// session, before any query is executed. It communicates with the frontend by
+// the provided MessageReadWriter, and writes the AuthenticationOk message once
+// the client is authenticated. Otherwise, it writes an ErrorResponse and
+// returns an error, which terminates the session. The provided Client
+// describes the connection and its startup arguments, which allows for schemes
+// like tokens, IP allow lists or external identity stores.
+type Authenticator interface {
+	Authenticate(rw protocol.MessageReadWriter, client *Client) error
+}
+
+// Client describes the client of a session, as it's known at startup
+type Client struct {
+	RemoteAddr net.Addr               // nil when the connection isn't a net.Conn
+	TLS        *tls.ConnectionState   // nil when the connection isn't over TLS
+	Args       map[string]interface{} // the startup arguments, like user and database
+}
+
 // Server is an interface for objects capable for handling the postgres protocol
 // by serving client connections. Each connection is assigned a Session that's
 // maintained in-memory until the connection is closed.
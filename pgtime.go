@@ -0,0 +1,131 @@
+package pgsrv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgtype"
+	"strings"
+	"time"
+)
+
+// timeOID is the OID of the time (without time zone) data type
+const timeOID pgtype.OID = 1083
+
+// pgTime is the time (without time zone) data type, which pgtype doesn't
+// implement. It's the time of day, in microseconds since midnight.
+type pgTime struct {
+	Microseconds int64
+	Status       pgtype.Status
+}
+
+func (dst *pgTime) Set(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*dst = pgTime{Status: pgtype.Null}
+	case time.Time:
+		value = value.Round(time.Microsecond)
+		midnight := time.Date(value.Year(), value.Month(), value.Day(), 0, 0, 0, 0, value.Location())
+		*dst = pgTime{Microseconds: int64(value.Sub(midnight) / time.Microsecond), Status: pgtype.Present}
+	case time.Duration:
+		if value < 0 || value > 24*time.Hour {
+			return fmt.Errorf("%v is out of range for time", value)
+		}
+		*dst = pgTime{Microseconds: int64(value / time.Microsecond), Status: pgtype.Present}
+	case string:
+		return dst.DecodeText(nil, []byte(value))
+	default:
+		return fmt.Errorf("cannot convert %v to time", value)
+	}
+	return nil
+}
+
+func (dst *pgTime) Get() interface{} {
+	switch dst.Status {
+	case pgtype.Present:
+		return time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(dst.Microseconds) * time.Microsecond)
+	case pgtype.Null:
+		return nil
+	default:
+		return dst.Status
+	}
+}
+
+func (src *pgTime) AssignTo(dst interface{}) error {
+	switch v := dst.(type) {
+	case *time.Time:
+		if src.Status != pgtype.Present {
+			return fmt.Errorf("cannot assign %v to %T", src, dst)
+		}
+		*v = src.Get().(time.Time)
+	case *time.Duration:
+		if src.Status != pgtype.Present {
+			return fmt.Errorf("cannot assign %v to %T", src, dst)
+		}
+		*v = time.Duration(src.Microseconds) * time.Microsecond
+	default:
+		return fmt.Errorf("cannot assign %v to %T", src, dst)
+	}
+	return nil
+}
+
+func (dst *pgTime) DecodeText(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		*dst = pgTime{Status: pgtype.Null}
+		return nil
+	}
+
+	for _, layout := range []string{"15:04:05.999999999", "15:04"} {
+		t, err := time.Parse(layout, strings.TrimSpace(string(src)))
+		if err == nil {
+			return dst.Set(t)
+		}
+	}
+	return fmt.Errorf("invalid time: %s", src)
+}
+
+func (dst *pgTime) DecodeBinary(ci *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		*dst = pgTime{Status: pgtype.Null}
+		return nil
+	}
+
+	if len(src) != 8 {
+		return fmt.Errorf("invalid length for time: %v", len(src))
+	}
+	*dst = pgTime{Microseconds: int64(binary.BigEndian.Uint64(src)), Status: pgtype.Present}
+	return nil
+}
+
+func (src *pgTime) EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.Status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+	return append(buf, formatClock(src.Microseconds)...), nil
+}
+
+func (src *pgTime) EncodeBinary(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	switch src.Status {
+	case pgtype.Null:
+		return nil, nil
+	case pgtype.Undefined:
+		return nil, fmt.Errorf("cannot encode status undefined")
+	}
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(src.Microseconds))
+	return append(buf, b...), nil
+}
+
+// formatClock formats a non negative number of microseconds as hours, minutes
+// and seconds, like 04:05:06.5
+func formatClock(microseconds int64) string {
+	secs := microseconds / 1000000
+	s := fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	if fraction := microseconds % 1000000; fraction != 0 {
+		s += strings.TrimRight(fmt.Sprintf(".%06d", fraction), "0")
+	}
+	return s
+}
@@ -0,0 +1,39 @@
+package pgsrv
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestPgTime(t *testing.T) {
+	t.Run("text format", func(t *testing.T) {
+		v := &pgTime{}
+		require.NoError(t, v.DecodeText(nil, []byte("04:05:06.5")))
+		require.Equal(t, int64(14706500000), v.Microseconds)
+
+		buf, err := v.EncodeText(nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, "04:05:06.5", string(buf))
+	})
+	t.Run("binary format", func(t *testing.T) {
+		v := &pgTime{}
+		require.NoError(t, v.DecodeBinary(nil, []byte{0, 0, 0, 0, 0, 0x0f, 0x42, 0x40}))
+		require.Equal(t, time.Date(0, 1, 1, 0, 0, 1, 0, time.UTC), v.Get())
+
+		require.Error(t, v.DecodeBinary(nil, []byte{1}))
+	})
+	t.Run("sets the time of day", func(t *testing.T) {
+		v := &pgTime{}
+		require.NoError(t, v.Set(time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+		buf, err := v.EncodeText(nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, "03:04:05", string(buf))
+	})
+	t.Run("null", func(t *testing.T) {
+		v := &pgTime{}
+		require.NoError(t, v.DecodeText(nil, nil))
+		require.Nil(t, v.Get())
+	})
+}
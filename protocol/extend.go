@@ -12,12 +12,29 @@ var ParseComplete = []byte{'1', 0, 0, 0, 4}
 // BindComplete is sent when backend prepared a portal and finished planning the query
 var BindComplete = []byte{'2', 0, 0, 0, 4}
 
+// CloseComplete is sent when backend closed a prepared statement or a portal
+var CloseComplete = []byte{'3', 0, 0, 0, 4}
+
+// PortalSuspended is sent when an Execute message's row limit was reached before
+// the portal was fully consumed
+var PortalSuspended = []byte{'s', 0, 0, 0, 4}
+
+// NoData is sent as a response to a Describe message of a statement or portal
+// that doesn't return rows
+var NoData = []byte{'n', 0, 0, 0, 4}
+
 // Describe message object types
 const (
 	DescribeStatement = 'S'
 	DescribePortal    = 'P'
 )
 
+// Close message object types
+const (
+	CloseStatement = 'S'
+	ClosePortal    = 'P'
+)
+
 // ParameterDescription is sent when backend received Describe message from frontend
 // with ObjectType = 'S' - requesting to describe prepared statement with a provided name
 func ParameterDescription(ps *nodes.PrepareStmt) (Message, error) {
@@ -42,6 +59,7 @@ type transaction struct {
 	transport *Transport
 	in        []pgproto3.FrontendMessage // TODO: asses if we need it after implementation of prepared statements and portals is done
 	out       []Message                  // TODO: add size limit
+	failed    bool                       // an error was written, even if already flushed
 }
 
 // NextFrontendMessage uses Transport to read the next message into the transaction's incoming messages buffer
@@ -54,15 +72,16 @@ func (t *transaction) NextFrontendMessage() (msg pgproto3.FrontendMessage, err e
 
 // Write writes the provided message into the transaction's outgoing messages buffer
 func (t *transaction) Write(msg Message) error {
-	if t.hasError() {
+	if t.failed {
 		return nil
 	}
 	t.out = append(t.out, msg)
+	t.failed = msg.IsError()
 	return nil
 }
 
 func (t *transaction) hasError() bool {
-	return len(t.out) > 0 && t.out[len(t.out)-1].IsError()
+	return t.failed
 }
 
 func (t *transaction) flush() (err error) {
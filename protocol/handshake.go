@@ -1,9 +1,11 @@
 package protocol
 
 import (
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 )
 
 // NewHandshake crates an Handshake
@@ -11,10 +13,25 @@ func NewHandshake(rw io.ReadWriter) *Handshake {
 	return &Handshake{rw: rw}
 }
 
+// NewTLSHandshake creates an Handshake that accepts SSL requests, by upgrading
+// the connection to TLS with the provided configuration
+func NewTLSHandshake(conn net.Conn, config *tls.Config) *Handshake {
+	return &Handshake{rw: conn, tlsConfig: config}
+}
+
 // Handshake handles the very first message passing of the protocol
 type Handshake struct {
-	rw     io.ReadWriter
-	passed bool
+	rw        io.ReadWriter
+	passed    bool
+	tlsConfig *tls.Config
+	tlsConn   *tls.Conn // the upgraded connection, once TLS is established
+}
+
+// TLSConn returns the connection upgraded to TLS by Init, or nil if the
+// frontend didn't request TLS or it isn't supported. Once upgraded, the rest
+// of the session must communicate over it.
+func (h *Handshake) TLSConn() *tls.Conn {
+	return h.tlsConn
 }
 
 // Write implements MessageReadWriter
@@ -32,8 +49,8 @@ func (h *Handshake) Read() (Message, error) {
 }
 
 // Init receives and validates the very first message from the frontend per session.
-// it may send message back to the frontend if needed to skip SSL request since it
-// currently not supported.
+// it may send message back to the frontend in response to an SSL request, and
+// upgrade the connection to TLS if it's supported (see NewTLSHandshake).
 //
 // once done, Init must not be called again, or error will be returned.
 func (h *Handshake) Init() (res Message, err error) {
@@ -54,8 +71,7 @@ func (h *Handshake) Init() (res Message, err error) {
 
 	// ssl request. see: SSLRequest in https://www.postgresql.org/docs/current/protocol-message-formats.html
 	if res.IsTLSRequest() {
-		// currently we don't support TLS.
-		_, err = h.rw.Write(TLSResponse(false))
+		err = h.upgrade()
 		if err != nil {
 			return nil, err
 		}
@@ -79,6 +95,26 @@ func (h *Handshake) Init() (res Message, err error) {
 	return res, nil
 }
 
+// upgrade responds to an SSL request, and establishes TLS if it's supported.
+// The frontend continues with a startup message in either case.
+func (h *Handshake) upgrade() error {
+	conn, ok := h.rw.(net.Conn)
+	supported := ok && h.tlsConfig != nil
+	_, err := h.rw.Write(TLSResponse(supported))
+	if err != nil || !supported {
+		return err
+	}
+
+	tlsConn := tls.Server(conn, h.tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+
+	h.rw, h.tlsConn = tlsConn, tlsConn
+	return nil
+}
+
 func (h *Handshake) readTypedMessage() (Message, error) {
 	msgType := Message(make([]byte, 1))
 	_, err := h.rw.Read(msgType)
@@ -45,6 +45,31 @@ func TestHandshake_Init(t *testing.T) {
 		require.Error(t, err, "expected error of unsupported version. got none")
 	})
 
+	t.Run("declines SSL requests without TLS", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		comm := bufio.NewReadWriter(bufio.NewReader(&buf), bufio.NewWriter(&buf))
+		handshake := NewHandshake(comm)
+
+		_, err := comm.Write([]byte{
+			0, 0, 0, 8, // length
+			4, 210, 22, 47, // 1234.5679
+			0, 0, 0, 8, // length
+			0, 3, 0, 0, // 3.0
+		})
+		require.NoError(t, err)
+
+		err = comm.Flush()
+		require.NoError(t, err)
+
+		_, err = handshake.Init()
+		require.NoError(t, err)
+		require.Nil(t, handshake.TLSConn())
+
+		err = comm.Flush()
+		require.NoError(t, err)
+		require.Equal(t, "N", buf.String())
+	})
+
 	t.Run("call init twice returns an error", func(t *testing.T) {
 		buf := bytes.Buffer{}
 		comm := bufio.NewReadWriter(bufio.NewReader(&buf), bufio.NewWriter(&buf))
@@ -38,7 +38,7 @@ func (m Message) ErrorResponse() (res *pgproto3.ErrorResponse, err error) {
 		return
 	}
 	res = &pgproto3.ErrorResponse{}
-	err = res.Decode(m[4:])
+	err = res.Decode(m[5:])
 	return
 }
 
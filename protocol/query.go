@@ -3,60 +3,59 @@ package protocol
 import (
 	"encoding/binary"
 	"fmt"
+	"github.com/jackc/pgx/pgio"
 )
 
-// TypesOid maps between a type name to its corresponding OID
-var TypesOid = map[string]int{
-	"BOOL":       16,
-	"BYTEA":      17,
-	"CHAR":       18,
-	"INT8":       20,
-	"INT2":       21,
-	"INT4":       23,
-	"TEXT":       25,
-	"JSON":       114,
-	"XML":        142,
-	"FLOAT4":     700,
-	"FLOAT8":     701,
-	"VARCHAR":    1043,
-	"DATE":       1082,
-	"TIME":       1083,
-	"TIMESTAMP":  1114,
-	"TIMESTAMPZ": 1184,
-	"INTERVAL":   1186,
-	"NUMERIC":    1700,
-	"JSONB":      3802,
-	"ANY":        2276,
-}
+// TransactionStatus is the status of the session's transaction block, as
+// reported to the frontend by ReadyForQuery messages
+type TransactionStatus byte
+
+const (
+	// TransactionIdle states that the session isn't in a transaction block
+	TransactionIdle TransactionStatus = 'I'
+	// TransactionInBlock states that the session is in a transaction block
+	TransactionInBlock TransactionStatus = 'T'
+	// TransactionInFailedBlock states that the session is in a failed
+	// transaction block, where commands are rejected until it's rolled back
+	TransactionInFailedBlock TransactionStatus = 'E'
+)
 
 // ReadyForQuery is sent whenever the backend is ready for a new query cycle.
 var ReadyForQuery = []byte{'Z', 0, 0, 0, 5, 'I'}
 
+// ReadyForQueryStatus is a ReadyForQuery message reporting the provided
+// transaction status
+func ReadyForQueryStatus(status TransactionStatus) Message {
+	return Message{'Z', 0, 0, 0, 5, byte(status)}
+}
+
+// Column describes a column of the rows delivered by DataRow messages
+type Column struct {
+	Name     string
+	TableOid uint32 // object ID of the source table; otherwise zero
+	AttrNum  int16  // attribute number of the source column; otherwise zero
+	TypeOid  uint32 // object ID of the column's data type
+	TypeLen  int16  // data type size, negative for variable-width types
+	TypeMod  int32  // type modifier, like the length of varchar; otherwise -1
+	Format   int16  // format code (text = 0, binary = 1)
+}
+
 // RowDescription is a message indicating that DataRow messages are about to
-// be transmitted and delivers their schema (column names/types)
-func RowDescription(cols, types []string) Message {
+// be transmitted and delivers their schema (column names/types/formats)
+func RowDescription(cols []Column) Message {
 	msg := []byte{'T' /* LEN = */, 0, 0, 0, 0 /* NUM FIELDS = */, 0, 0}
 	binary.BigEndian.PutUint16(msg[5:], uint16(len(cols)))
 
-	for i, c := range cols {
-		msg = append(msg, []byte(c)...)
+	for _, c := range cols {
+		msg = append(msg, []byte(c.Name)...)
 		msg = append(msg, 0) // NULL TERMINATED
 
-		msg = append(msg, 0, 0, 0, 0) // object ID of the table; otherwise zero
-		msg = append(msg, 0, 0)       // attribute number of the column; otherwise zero
-
-		// object ID of the field's data type
-		typeOid := TypesOid[types[i]]
-		if typeOid == 0 {
-			typeOid = TypesOid["TEXT"]
-		}
-
-		oid := []byte{0, 0, 0, 0}
-		binary.BigEndian.PutUint32(oid, uint32(typeOid))
-		msg = append(msg, oid...)
-		msg = append(msg, 0, 0)       // data type size
-		msg = append(msg, 0, 0, 0, 0) // type modifier
-		msg = append(msg, 0, 0)       // format code (text = 0, binary = 1)
+		msg = pgio.AppendUint32(msg, c.TableOid)
+		msg = pgio.AppendInt16(msg, c.AttrNum)
+		msg = pgio.AppendUint32(msg, c.TypeOid)
+		msg = pgio.AppendInt16(msg, c.TypeLen)
+		msg = pgio.AppendInt32(msg, c.TypeMod)
+		msg = pgio.AppendInt16(msg, c.Format)
 	}
 
 	// write the length
@@ -64,15 +63,24 @@ func RowDescription(cols, types []string) Message {
 	return msg
 }
 
-// DataRow is sent for every row of resulted row set
-func DataRow(vals []string) Message {
+// DataRow is sent for every row of resulted row set. nil values are sent as
+// NULLs.
+func DataRow(vals [][]byte) Message {
 	msg := []byte{'D' /* LEN = */, 0, 0, 0, 0 /* NUM VALS = */, 0, 0}
 	binary.BigEndian.PutUint16(msg[5:], uint16(len(vals)))
 
 	for _, v := range vals {
-		b := append(make([]byte, 4), []byte(v)...)
-		binary.BigEndian.PutUint32(b[0:4], uint32(len(b)-4))
+		b := make([]byte, 4)
+		if v == nil {
+			// NULLs are indicated by a length of -1, with no value bytes
+			binary.BigEndian.PutUint32(b, 0xFFFFFFFF)
+			msg = append(msg, b...)
+			continue
+		}
+
+		binary.BigEndian.PutUint32(b, uint32(len(v)))
 		msg = append(msg, b...)
+		msg = append(msg, v...)
 	}
 
 	// write the length
@@ -91,6 +99,9 @@ func CommandComplete(tag string) Message {
 	return msg
 }
 
+// EmptyQueryResponse is sent instead of CommandComplete when the query is empty
+var EmptyQueryResponse = []byte{'I', 0, 0, 0, 4}
+
 // ErrorResponse is sent whenever error has occurred
 func ErrorResponse(err error) Message {
 	msg := []byte{'E', 0, 0, 0, 0}
@@ -10,6 +10,11 @@ func TestReadyMsg(t *testing.T) {
 	require.Equal(t, []byte{'Z', 0, 0, 0, 5, 'I'}, []byte(msg))
 }
 
+func TestReadyForQueryStatus(t *testing.T) {
+	msg := ReadyForQueryStatus(TransactionInFailedBlock)
+	require.Equal(t, []byte{'Z', 0, 0, 0, 5, 'E'}, []byte(msg))
+}
+
 func TestCompleteMsg(t *testing.T) {
 	msg := CommandComplete("meh")
 	expectedMsg := []byte{
@@ -21,3 +26,43 @@ func TestCompleteMsg(t *testing.T) {
 
 	require.Equal(t, expectedMsg, []byte(msg))
 }
+
+func TestDataRow(t *testing.T) {
+	msg := DataRow([][]byte{[]byte("a"), nil, {}})
+	expectedMsg := []byte{
+		'D',         // type
+		0, 0, 0, 19, // size
+		0, 3, // number of values
+		0, 0, 0, 1, 'a', // a
+		255, 255, 255, 255, // NULL
+		0, 0, 0, 0, // empty
+	}
+
+	require.Equal(t, expectedMsg, []byte(msg))
+}
+
+func TestRowDescription(t *testing.T) {
+	msg := RowDescription([]Column{{
+		Name:     "a",
+		TableOid: 1000,
+		AttrNum:  2,
+		TypeOid:  1043,
+		TypeLen:  -1,
+		TypeMod:  259,
+		Format:   1,
+	}})
+	expectedMsg := []byte{
+		'T',         // type
+		0, 0, 0, 26, // size
+		0, 1, // number of fields
+		'a', 0, // name
+		0, 0, 3, 232, // table OID
+		0, 2, // attribute number
+		0, 0, 4, 19, // type OID
+		255, 255, // type size
+		0, 0, 1, 3, // type modifier
+		0, 1, // format code
+	}
+
+	require.Equal(t, expectedMsg, []byte(msg))
+}
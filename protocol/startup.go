@@ -82,6 +82,9 @@ func TLSResponse(supported bool) Message {
 	return Message([]byte{b})
 }
 
+// AuthenticationOk is sent once the client is authenticated
+var AuthenticationOk = []byte{'R', 0, 0, 0, 8, 0, 0, 0, 0}
+
 // BackendKeyData creates a new message providing the client with a process ID and
 // secret key that it can later use to cancel running queries
 func BackendKeyData(pid int32, secret int32) Message {
@@ -25,8 +25,9 @@ const (
 func NewTransport(rw io.ReadWriter) *Transport {
 	b, _ := pgproto3.NewBackend(rw, nil)
 	return &Transport{
-		w: rw,
-		r: b,
+		w:      rw,
+		r:      b,
+		status: TransactionIdle,
 	}
 }
 
@@ -35,6 +36,18 @@ type Transport struct {
 	w           io.Writer
 	r           *pgproto3.Backend
 	transaction *transaction
+	status      TransactionStatus
+}
+
+// TransactionStatus returns the status of the session's transaction block
+func (t *Transport) TransactionStatus() TransactionStatus {
+	return t.status
+}
+
+// SetTransactionStatus sets the status of the session's transaction block, to
+// be reported by the following ReadyForQuery messages
+func (t *Transport) SetTransactionStatus(status TransactionStatus) {
+	t.status = status
 }
 
 func (t *Transport) beginTransaction() {
@@ -50,21 +63,21 @@ func (t *Transport) endTransaction() (err error) {
 // NextFrontendMessage reads and returns a single message from the connection when available.
 // if within a transaction, the transaction will read from the connection,
 // otherwise a ReadyForQuery message will first be sent to the frontend and then reading
-// a single message from the connection will happen
+// a single message from the connection will happen. Flush messages, and messages
+// discarded due to a failed transaction, are never returned
 //
 // NextFrontendMessage expects to be called only after a call to Handshake without an error response
 // otherwise, an error is returned
 func (t *Transport) NextFrontendMessage() (msg pgproto3.FrontendMessage, ts TransactionState, err error) {
 	if t.transaction == nil {
 		// when not in transaction, client waits for ReadyForQuery before sending next message
-		err = t.Write(ReadyForQuery)
+		err = t.Write(ReadyForQueryStatus(t.status))
 		if err != nil {
 			return
 		}
-		msg, err = t.readFrontendMessage()
-	} else {
-		msg, err = t.transaction.NextFrontendMessage()
 	}
+
+	msg, err = t.nextMessage()
 	if err != nil {
 		return
 	}
@@ -73,10 +86,45 @@ func (t *Transport) NextFrontendMessage() (msg pgproto3.FrontendMessage, ts Tran
 	return
 }
 
+// nextMessage reads the next message to be handled by the backend. Flush
+// messages are handled right away by sending all of the transaction's pending
+// messages, without ending it. Once the transaction has failed, all messages
+// are discarded until the next Sync, as required by the extended query flow.
+func (t *Transport) nextMessage() (msg pgproto3.FrontendMessage, err error) {
+	for {
+		if t.transaction == nil {
+			msg, err = t.readFrontendMessage()
+		} else {
+			msg, err = t.transaction.NextFrontendMessage()
+		}
+		if err != nil {
+			return
+		}
+
+		switch msg.(type) {
+		case *pgproto3.Flush:
+			if t.transaction != nil {
+				err = t.transaction.flush()
+				if err != nil {
+					return
+				}
+			}
+			continue
+		case *pgproto3.Sync:
+			return
+		}
+
+		if t.transaction != nil && t.transaction.hasError() {
+			continue
+		}
+		return
+	}
+}
+
 func (t *Transport) affectTransaction(msg pgproto3.FrontendMessage) (ts TransactionState, err error) {
 	if t.transaction == nil {
 		switch msg.(type) {
-		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe:
+		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
 			t.beginTransaction()
 			ts = InTransaction
 		default:
@@ -107,8 +155,13 @@ func (t *Transport) readFrontendMessage() (pgproto3.FrontendMessage, error) {
 	return t.r.Receive()
 }
 
-// Write writes the provided message to the client connection
+// Write writes the provided message to the client connection. Errors within a
+// transaction block fail it.
 func (t *Transport) Write(m Message) error {
+	if t.status == TransactionInBlock && m.IsError() {
+		t.status = TransactionInFailedBlock
+	}
+
 	if t.transaction != nil {
 		return t.transaction.Write(m)
 	}
@@ -174,5 +174,106 @@ func TestTransport_Read(t *testing.T) {
 
 			require.Nil(t, transport.transaction, "expected protocol to end transaction")
 		})
+
+		t.Run("flushes transaction", func(t *testing.T) {
+			f, b := net.Pipe()
+
+			transport := NewTransport(b)
+
+			go func() {
+				for {
+					m, _, err := transport.NextFrontendMessage()
+					require.NoError(t, err)
+					require.NotEqual(t, &pgproto3.Flush{}, m, "expected protocol to handle Flush")
+
+					if _, ok := m.(*pgproto3.Parse); ok {
+						err = transport.Write(ParseComplete)
+						require.NoError(t, err)
+					}
+				}
+			}()
+
+			err := runStory(t, f, []pgstories.Step{
+				&pgstories.Response{BackendMessage: &pgproto3.ReadyForQuery{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Parse{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Flush{}},
+				&pgstories.Response{BackendMessage: &pgproto3.ParseComplete{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Sync{}},
+				&pgstories.Response{BackendMessage: &pgproto3.ReadyForQuery{}},
+			})
+
+			require.NoError(t, err)
+		})
+
+		t.Run("discards messages until sync", func(t *testing.T) {
+			f, b := net.Pipe()
+
+			transport := NewTransport(b)
+
+			received := make(chan pgproto3.FrontendMessage, 10)
+			go func() {
+				for {
+					m, _, err := transport.NextFrontendMessage()
+					require.NoError(t, err)
+					received <- m
+
+					if _, ok := m.(*pgproto3.Parse); ok {
+						err = transport.Write(ErrorResponse(fmt.Errorf("dosn't matter")))
+						require.NoError(t, err)
+					}
+				}
+			}()
+
+			err := runStory(t, f, []pgstories.Step{
+				&pgstories.Response{BackendMessage: &pgproto3.ReadyForQuery{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Parse{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Flush{}},
+				&pgstories.Response{BackendMessage: &pgproto3.ErrorResponse{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Bind{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Query{}},
+				&pgstories.Command{FrontendMessage: &pgproto3.Sync{}},
+				&pgstories.Response{BackendMessage: &pgproto3.ReadyForQuery{}},
+			})
+
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.Parse{}, <-received)
+			require.IsType(t, &pgproto3.Sync{}, <-received)
+		})
+
+		t.Run("reports transaction status", func(t *testing.T) {
+			f, b := net.Pipe()
+
+			transport := NewTransport(b)
+
+			go func() {
+				for {
+					_, _, err := transport.NextFrontendMessage()
+					require.NoError(t, err)
+
+					transport.SetTransactionStatus(TransactionInBlock)
+					err = transport.Write(ErrorResponse(fmt.Errorf("dosn't matter")))
+					require.NoError(t, err)
+				}
+			}()
+
+			frontend, err := pgproto3.NewFrontend(f, f)
+			require.NoError(t, err)
+
+			m, err := frontend.Receive()
+			require.NoError(t, err)
+			require.Equal(t, byte(TransactionIdle), m.(*pgproto3.ReadyForQuery).TxStatus)
+
+			err = frontend.Send(&pgproto3.Query{})
+			require.NoError(t, err)
+
+			m, err = frontend.Receive()
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.ErrorResponse{}, m)
+
+			m, err = frontend.Receive()
+			require.NoError(t, err)
+			require.Equal(t, byte(TransactionInFailedBlock), m.(*pgproto3.ReadyForQuery).TxStatus,
+				"expected errors to fail the transaction block")
+		})
 	})
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql/driver"
 	"fmt"
+	"github.com/jackc/pgx/pgtype"
 	parser "github.com/lfittl/pg_query_go"
 	nodes "github.com/lfittl/pg_query_go/nodes"
 	"github.com/panoplyio/pgsrv/protocol"
@@ -11,11 +12,20 @@ import (
 )
 
 type query struct {
-	transport *protocol.Transport
-	queryer   Queryer
-	execer    Execer
-	sql       string
-	numCols   int
+	transport       *protocol.Transport
+	connInfo        *pgtype.ConnInfo // encodes the result values
+	types           *Types           // describes the result columns
+	queryer         Queryer
+	execer          Execer
+	queryerWithArgs QueryerWithArgs    // optional, used for bound statements
+	execerWithArgs  ExecerWithArgs     // optional, used for bound statements
+	describer       Describer          // optional, used for Describe messages
+	transactor      Transactor         // optional, used for transaction blocks
+	ctx             context.Context    // the query's own context, canceled by cancel requests
+	cancel          context.CancelFunc // cancels ctx once the query is done, nil when a portal keeps it
+	canceled        bool               // the cancellation was already reported
+	sql             string
+	numCols         int
 }
 
 // Run the query using the Server's defined queryer
@@ -23,33 +33,55 @@ func (q *query) Run(sess Session) error {
 	// parse the query
 	ast, err := parser.Parse(q.sql)
 	if err != nil {
-		return q.transport.Write(protocol.ErrorResponse(err))
+		return q.writeError(err)
 	}
 
-	// add the session to the context, cast to the Session interface just for
-	// compile time verification that the interface is implemented.
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, sessionCtxKey, sess)
-	ctx = context.WithValue(ctx, sqlCtxKey, q.sql)
-	ctx = context.WithValue(ctx, astCtxKey, ast)
+	if len(ast.Statements) == 0 {
+		return q.transport.Write(protocol.EmptyQueryResponse)
+	}
+
+	ctx := queryContext(q.ctx, sess, q.sql, ast)
 
 	// execute all of the statements
 	for _, stmt := range ast.Statements {
+		if q.ctx.Err() != nil {
+			// the rest of the statements are canceled as well
+			if q.canceled {
+				return nil
+			}
+			return q.writeError(q.ctx.Err())
+		}
+
 		rawStmt, isRaw := stmt.(nodes.RawStmt)
 		if isRaw {
 			stmt = rawStmt.Stmt
 		}
 
+		if aborted(q.transport.TransactionStatus(), stmt) {
+			return q.writeError(InFailedSQLTransaction())
+		}
+
+		// the handlers return their errors rather than reporting them, so that
+		// like in Postgres, the first error is reported once and the rest of
+		// the statements are skipped
+
 		// determine if it's a query or command
 		switch v := stmt.(type) {
+		case nodes.TransactionStmt:
+			err = q.Transaction(ctx, sess, v)
 		case nodes.PrepareStmt:
-			s, ok := sess.(*session)
-			// only session implementation is capable of storing prepared stmts
-			if ok {
-				// we just store the statement and don't do anything
-				s.storePreparedStatement(&v)
+			err = q.Prepare(ctx, sess, v)
+		case nodes.ExecuteStmt:
+			err = q.ExecutePrepared(sess, v)
+		case nodes.VariableSetStmt:
+			err = q.Set(ctx, sess, v)
+		case nodes.DeallocateStmt:
+			err = q.Deallocate(sess, v)
+		case nodes.DiscardStmt:
+			if v.Target == nodes.DISCARD_ALL {
+				err = q.DiscardAll(sess)
 			} else {
-				return Unsupported("prepared statements")
+				err = q.Exec(ctx, stmt)
 			}
 		case nodes.SelectStmt, nodes.VariableShowStmt:
 			err = q.Query(ctx, stmt)
@@ -58,63 +90,498 @@ func (q *query) Run(sess Session) error {
 		}
 
 		if err != nil {
-			return q.transport.Write(protocol.ErrorResponse(err))
+			return q.writeError(err)
 		}
 	}
 	return nil
 }
 
+// Prepare stores the statement prepared by SQL PREPARE in the session. The
+// types of its parameters are resolved just like the ones of Parse messages,
+// so that it can be executed by either SQL EXECUTE or Bind messages.
+func (q *query) Prepare(ctx context.Context, sess Session, stmt nodes.PrepareStmt) error {
+	s, ok := sess.(*session)
+	if !ok {
+		// only session implementation is capable of storing prepared stmts
+		return Unsupported("prepared statements")
+	}
+
+	oids := make([]uint32, len(stmt.Argtypes.Items))
+	for i, n := range stmt.Argtypes.Items {
+		typ := n.(nodes.TypeName)
+		dt, ok := s.dataType(typ)
+		if !ok {
+			return UndefinedType(typeNameString(typ))
+		}
+		oids[i] = uint32(dt.OID)
+	}
+
+	argtypes, err := s.paramTypes(ctx, stmt.Query, oids)
+	if err != nil {
+		return err
+	}
+
+	stmt.Argtypes = nodes.List{Items: argtypes}
+	// just like in Postgres, SQL PREPARE isn't transactional, so unlike Parse
+	// it doesn't depend on the success of the extended query batch
+	s.deallocate(stmtName(&stmt))
+	s.stmts[stmtName(&stmt)] = &stmt
+	return q.transport.Write(protocol.CommandComplete("PREPARE"))
+}
+
+// ExecutePrepared runs the session's prepared statement with the arguments of
+// SQL EXECUTE bound into it. It's then dispatched as any other query or
+// command, along with its rows schema.
+func (q *query) ExecutePrepared(sess Session, stmt nodes.ExecuteStmt) error {
+	s, ok := sess.(*session)
+	if !ok {
+		return Unsupported("prepared statements")
+	}
+
+	name := ""
+	if stmt.Name != nil {
+		name = *stmt.Name
+	}
+
+	ps, ok := s.preparedStatement(name)
+	if !ok {
+		return InvalidSQLStatementName(name)
+	}
+
+	bound, err := s.bindArgs(ps, stmt.Params.Items)
+	if err != nil {
+		return err
+	}
+
+	if bound == nil {
+		// the statement was prepared from an empty query
+		return q.transport.Write(protocol.EmptyQueryResponse)
+	}
+
+	bound = unwrapStmt(bound)
+	ctx := queryContext(q.ctx, sess, q.sql, parser.ParsetreeList{Statements: []nodes.Node{bound}})
+	if stmt, ok := bound.(nodes.TransactionStmt); ok {
+		return q.Transaction(ctx, sess, stmt)
+	}
+	if isQuery(bound) {
+		return q.Query(ctx, bound)
+	}
+	return q.Exec(ctx, bound)
+}
+
+// Transaction executes a transaction control statement, like BEGIN or COMMIT,
+// and updates the session's transaction status accordingly. COMMIT of a failed
+// transaction block rolls it back instead. Backends implementing Transactor
+// handle the statement with their Tx, others execute it as a command.
+func (q *query) Transaction(ctx context.Context, sess Session, stmt nodes.TransactionStmt) error {
+	before := q.transport.TransactionStatus()
+	if stmt.Kind == nodes.TRANS_STMT_COMMIT && before == protocol.TransactionInFailedBlock {
+		stmt.Kind = nodes.TRANS_STMT_ROLLBACK
+	}
+
+	var res driver.Result
+	var err error
+	if s, ok := sess.(*session); ok && q.transactor != nil {
+		res, err = driver.ResultNoRows, s.transact(ctx, q.transactor, stmt)
+	} else {
+		res, err = q.execer.Exec(ctx, stmt)
+	}
+	writeErr := q.writeResult(stmt, res, err)
+
+	// errors fail the transaction block, if any, once they're reported
+	status := q.transport.TransactionStatus()
+	switch stmt.Kind {
+	case nodes.TRANS_STMT_BEGIN, nodes.TRANS_STMT_START:
+		if err == nil && before == protocol.TransactionIdle {
+			status = protocol.TransactionInBlock
+		}
+	case nodes.TRANS_STMT_COMMIT, nodes.TRANS_STMT_ROLLBACK, nodes.TRANS_STMT_PREPARE:
+		// the transaction block ends even if it failed to commit
+		status = protocol.TransactionIdle
+	case nodes.TRANS_STMT_ROLLBACK_TO:
+		if err == nil && before == protocol.TransactionInFailedBlock {
+			status = protocol.TransactionInBlock
+		}
+	}
+
+	q.transport.SetTransactionStatus(status)
+	if s, ok := sess.(*session); ok && status == protocol.TransactionIdle {
+		committed := err == nil && stmt.Kind != nodes.TRANS_STMT_ROLLBACK
+		s.endLocalTimeouts(!committed)
+	}
+	return writeErr
+}
+
+// aborted determines if the statement must be rejected as the session is in a
+// failed transaction block. Only statements that end the transaction block, or
+// roll back to a savepoint, are allowed.
+func aborted(status protocol.TransactionStatus, stmt nodes.Node) bool {
+	if status != protocol.TransactionInFailedBlock {
+		return false
+	}
+
+	v, ok := stmt.(nodes.TransactionStmt)
+	if !ok {
+		return true
+	}
+
+	switch v.Kind {
+	case nodes.TRANS_STMT_COMMIT, nodes.TRANS_STMT_ROLLBACK, nodes.TRANS_STMT_ROLLBACK_TO:
+		return false
+	default:
+		return true
+	}
+}
+
+// Set handles SET and RESET of the settings the session enforces itself, like
+// statement_timeout. The rest of the settings are left for the backend, which
+// executes them as commands.
+func (q *query) Set(ctx context.Context, sess Session, stmt nodes.VariableSetStmt) error {
+	if s, ok := sess.(*session); ok {
+		inBlock := q.transport.TransactionStatus() != protocol.TransactionIdle
+		if inBlock {
+			// SET is reverted if the transaction block is rolled back
+			s.saveTimeouts()
+		}
+
+		handled, err := s.setTimeout(stmt)
+		if err != nil {
+			return err
+		}
+		if !inBlock {
+			// just like in Postgres, SET LOCAL has no effect outside of
+			// transaction blocks
+			s.endLocalTimeouts(false)
+		}
+		if handled {
+			return q.writeResult(stmt, driver.ResultNoRows, nil)
+		}
+	}
+	return q.Exec(ctx, stmt)
+}
+
+// Deallocate removes the session's prepared statement, or all of them when
+// no name is provided (DEALLOCATE ALL)
+func (q *query) Deallocate(sess Session, stmt nodes.DeallocateStmt) error {
+	s, ok := sess.(*session)
+	if !ok {
+		// only session implementation is capable of storing prepared stmts
+		return Unsupported("prepared statements")
+	}
+
+	if stmt.Name == nil {
+		s.deallocateAll()
+		return q.transport.Write(protocol.CommandComplete("DEALLOCATE ALL"))
+	}
+
+	if _, ok := s.preparedStatement(*stmt.Name); !ok {
+		return InvalidSQLStatementName(*stmt.Name)
+	}
+
+	s.deallocate(*stmt.Name)
+	return q.transport.Write(protocol.CommandComplete("DEALLOCATE"))
+}
+
+// DiscardAll releases all of the session's prepared statements and portals.
+// Just like in Postgres, it can't run inside a transaction block.
+func (q *query) DiscardAll(sess Session) error {
+	s, ok := sess.(*session)
+	if !ok {
+		return Unsupported("DISCARD ALL")
+	}
+
+	if q.transport.TransactionStatus() != protocol.TransactionIdle {
+		return ActiveSQLTransaction("DISCARD ALL cannot run inside a transaction block")
+	}
+
+	s.deallocateAll()
+	s.closePortals()
+	return q.transport.Write(protocol.CommandComplete("DISCARD ALL"))
+}
+
+// Execute runs the statement bound to the portal as part of the extended query
+// flow. Unlike Run, the rows schema isn't sent, as the frontend is expected to
+// request it separately with a Describe message.
+//
+// At most limit rows are sent (zero means no limit) before the portal is
+// suspended. The rows remain open on the portal, so that subsequent calls
+// resume streaming from the same position.
+func (q *query) Execute(sess Session, p *portal, limit int) error {
+	err := q.executePortal(sess, p, limit)
+	if err != nil {
+		return q.writeError(err)
+	}
+	return nil
+}
+
+// executePortal is Execute, returning the error to be reported rather than
+// reporting it
+func (q *query) executePortal(sess Session, p *portal, limit int) error {
+	if p.query == nil {
+		// the portal's statement is an empty query
+		return q.transport.Write(protocol.EmptyQueryResponse)
+	}
+
+	if aborted(q.transport.TransactionStatus(), unwrapStmt(p.query)) {
+		return InFailedSQLTransaction()
+	}
+
+	if stmt, ok := unwrapStmt(p.query).(nodes.TransactionStmt); ok {
+		if p.done {
+			return ObjectNotInPrerequisiteState("portal \"%s\" cannot be run", p.name)
+		}
+
+		p.done = true
+		ctx := queryContext(q.ctx, sess, q.sql, parser.ParsetreeList{Statements: []nodes.Node{stmt}})
+		return q.Transaction(ctx, sess, stmt)
+	}
+
+	if !isQuery(unwrapStmt(p.query)) {
+		if p.done {
+			return ObjectNotInPrerequisiteState("portal \"%s\" cannot be run", p.name)
+		}
+
+		p.done = true
+		ctx, stmt, args := q.portalStmt(sess, p)
+		if args != nil {
+			res, err := q.execerWithArgs.ExecArgs(ctx, stmt, args)
+			return q.writeResult(stmt, res, err)
+		}
+		return q.Exec(ctx, stmt)
+	}
+
+	if p.done {
+		// the rows were already exhausted by previous executions
+		return q.transport.Write(protocol.CommandComplete("SELECT 0"))
+	}
+
+	if p.rows == nil {
+		err := q.open(sess, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	done, err := q.writeRows(p.rows, p.formats, limit)
+	if done {
+		p.done = true
+		p.close()
+	}
+	return err
+}
+
+// Describe returns the RowDescription of the rows the provided statement
+// returns, or NoData if it doesn't return any rows. Describing a query requires
+// the backend to implement Describer. The columns are described in the
+// provided result formats, which are all text for prepared statements.
+func (q *query) Describe(sess Session, stmt nodes.Node, formats []int16) (protocol.Message, error) {
+	stmt = unwrapStmt(stmt)
+	if !isQuery(stmt) {
+		return protocol.NoData, nil
+	}
+
+	if q.describer == nil {
+		return nil, Unsupported("statement description. Describer isn't implemented.")
+	}
+
+	ctx := queryContext(q.ctx, sess, q.sql, parser.ParsetreeList{Statements: []nodes.Node{stmt}})
+	rows, err := q.describer.Describe(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		return protocol.NoData, nil
+	}
+	defer rows.Close()
+
+	return q.rowDescription(rows, formats)
+}
+
+// DescribePortal is like Describe, for the statement bound to the portal. When
+// the backend doesn't implement Describer, the portal's query is executed and
+// its rows are described instead. These rows remain open on the portal to be
+// streamed by the following Execute.
+func (q *query) DescribePortal(sess Session, p *portal) (protocol.Message, error) {
+	if q.describer != nil || !isQuery(unwrapStmt(p.query)) {
+		return q.Describe(sess, p.query, p.formats)
+	}
+
+	if p.rows == nil {
+		if p.done {
+			return nil, ObjectNotInPrerequisiteState("portal \"%s\" cannot be described", p.name)
+		}
+
+		err := q.open(sess, p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q.rowDescription(p.rows, p.formats)
+}
+
+// open runs the portal's query, keeping its rows open on the portal. The rows
+// are bound to the query's context, so it's kept by the portal as well, for the
+// following executions to resume with.
+func (q *query) open(sess Session, p *portal) (err error) {
+	ctx, stmt, args := q.portalStmt(sess, p)
+	if args != nil {
+		p.rows, err = q.queryerWithArgs.QueryArgs(ctx, stmt, args)
+	} else {
+		p.rows, err = q.queryer.Query(ctx, stmt)
+	}
+	if err != nil {
+		return
+	}
+
+	p.ctx, p.cancel = q.ctx, q.cancel
+	q.cancel = nil
+	return
+}
+
+// portalStmt returns the portal's statement to be executed with its context.
+// Backends accepting the arguments separately receive the statement as it was
+// prepared, with its parameter placeholders, along with the arguments.
+func (q *query) portalStmt(sess Session, p *portal) (ctx context.Context, stmt nodes.Node, args []driver.NamedValue) {
+	stmt = unwrapStmt(p.query)
+	if isQuery(stmt) && q.queryerWithArgs != nil || !isQuery(stmt) && q.execerWithArgs != nil {
+		stmt, args = unwrapStmt(p.stmt.Query), p.args
+	}
+
+	ctx = queryContext(q.ctx, sess, q.sql, parser.ParsetreeList{Statements: []nodes.Node{stmt}})
+	return
+}
+
+// isQuery determines if the statement is a query that returns rows, rather
+// than a command
+func isQuery(stmt nodes.Node) bool {
+	switch stmt.(type) {
+	case nodes.SelectStmt, nodes.VariableShowStmt:
+		return true
+	default:
+		return false
+	}
+}
+
+// unwrapStmt returns the actual statement of a raw statement, as produced by
+// the parser
+func unwrapStmt(stmt nodes.Node) nodes.Node {
+	rawStmt, isRaw := stmt.(nodes.RawStmt)
+	if isRaw {
+		return rawStmt.Stmt
+	}
+	return stmt
+}
+
+// queryContext creates the context of the queries sent to the backend, derived
+// from the provided parent context. add the session to the context, cast to the
+// Session interface just for compile time verification that the interface is
+// implemented.
+func queryContext(parent context.Context, sess Session, sql string, ast parser.ParsetreeList) context.Context {
+	ctx := context.WithValue(parent, sessionCtxKey, sess)
+	ctx = context.WithValue(ctx, sqlCtxKey, sql)
+	ctx = context.WithValue(ctx, astCtxKey, ast)
+	return ctx
+}
+
 func (q *query) Query(ctx context.Context, n nodes.Node) error {
 	rows, err := q.queryer.Query(ctx, n)
 	if err != nil {
-		return q.transport.Write(protocol.ErrorResponse(err))
+		return err
 	}
+	defer rows.Close()
 
-	// build columns from the provided columns list
-	cols := rows.Columns()
-	types := make([]string, len(cols))
-	rowsTypes, ok := rows.(driver.RowsColumnTypeDatabaseTypeName)
-	for i := 0; i < len(types) && ok; i++ {
-		types[i] = rowsTypes.ColumnTypeDatabaseTypeName(i)
+	desc, err := q.rowDescription(rows, nil)
+	if err != nil {
+		return err
 	}
 
-	err = q.transport.Write(protocol.RowDescription(cols, types))
+	err = q.transport.Write(desc)
 	if err != nil {
 		return err
 	}
 
+	_, err = q.writeRows(rows, nil, 0)
+	return err
+}
+
+// writeRows streams up to limit rows (zero means no limit) as DataRow messages,
+// with the values encoded in the requested result formats. It completes the
+// command once the rows are exhausted, or suspends the portal when the limit
+// is reached first. done reports if no more rows are expected.
+func (q *query) writeRows(rows driver.Rows, formats []int16, limit int) (done bool, err error) {
+	cols, err := q.columns(rows, formats)
+	if err != nil {
+		return true, err
+	}
+
 	count := 0
 	row := make([]driver.Value, len(cols))
-	strings := make([]string, len(cols))
 	for {
+		if limit > 0 && count >= limit {
+			return false, q.transport.Write(protocol.PortalSuspended)
+		}
+
+		if q.ctx.Err() != nil {
+			return true, q.ctx.Err()
+		}
+
 		err = rows.Next(row)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return q.transport.Write(protocol.ErrorResponse(err))
+			return true, err
 		}
 
-		// convert the values to string
+		// encode the values in the format of their columns' types
+		vals := make([][]byte, len(row))
 		for i, v := range row {
-			strings[i] = fmt.Sprintf("%v", v)
+			oid := pgtype.OID(cols[i].TypeOid)
+			if cols[i].Format == binaryFormat {
+				vals[i], err = encodeBinary(q.connInfo, oid, v)
+			} else {
+				vals[i], err = encodeText(q.connInfo, oid, v)
+			}
+			if err != nil {
+				return true, err
+			}
 		}
 
-		err = q.transport.Write(protocol.DataRow(strings))
+		err = q.transport.Write(protocol.DataRow(vals))
 		if err != nil {
-			return err
+			return true, err
 		}
 
 		count++
 	}
 
 	tag := fmt.Sprintf("SELECT %d", count)
-	return q.transport.Write(protocol.CommandComplete(tag))
+	return true, q.transport.Write(protocol.CommandComplete(tag))
+}
+
+// writeError reports the error to the frontend. Once the query is canceled, or
+// times out, all errors are reported as such, as they're likely caused by it.
+func (q *query) writeError(err error) error {
+	switch q.ctx.Err() {
+	case context.Canceled:
+		err = QueryCanceled()
+		q.canceled = true
+	case context.DeadlineExceeded:
+		err = StatementTimeout()
+		q.canceled = true
+	}
+	return q.transport.Write(protocol.ErrorResponse(err))
 }
 
 func (q *query) Exec(ctx context.Context, n nodes.Node) error {
 	res, err := q.execer.Exec(ctx, n)
+	return q.writeResult(n, res, err)
+}
+
+// writeResult completes the executed command, tagged according to its result.
+// The command's error is returned instead, to be reported by the caller.
+func (q *query) writeResult(n nodes.Node, res driver.Result, err error) error {
 	if err != nil {
-		return q.transport.Write(protocol.ErrorResponse(err))
+		return err
 	}
 
 	t, ok := res.(ResultTag)
@@ -124,7 +591,7 @@ func (q *query) Exec(ctx context.Context, n nodes.Node) error {
 
 	tag, err := t.Tag()
 	if err != nil {
-		return q.transport.Write(protocol.ErrorResponse(err))
+		return err
 	}
 	return q.transport.Write(protocol.CommandComplete(tag))
 }
@@ -183,6 +650,28 @@ func (res *tagger) Tag() (tag string, err error) {
 		tag = "CREATE TABLE"
 	case nodes.UpdateStmt:
 		tag = "UPDATE"
+	case nodes.TransactionStmt:
+		skipResults = true
+		switch res.Node.(nodes.TransactionStmt).Kind {
+		case nodes.TRANS_STMT_BEGIN:
+			tag = "BEGIN"
+		case nodes.TRANS_STMT_START:
+			tag = "START TRANSACTION"
+		case nodes.TRANS_STMT_COMMIT:
+			tag = "COMMIT"
+		case nodes.TRANS_STMT_ROLLBACK, nodes.TRANS_STMT_ROLLBACK_TO:
+			tag = "ROLLBACK"
+		case nodes.TRANS_STMT_SAVEPOINT:
+			tag = "SAVEPOINT"
+		case nodes.TRANS_STMT_RELEASE:
+			tag = "RELEASE"
+		case nodes.TRANS_STMT_PREPARE:
+			tag = "PREPARE TRANSACTION"
+		case nodes.TRANS_STMT_COMMIT_PREPARED:
+			tag = "COMMIT PREPARED"
+		case nodes.TRANS_STMT_ROLLBACK_PREPARED:
+			tag = "ROLLBACK PREPARED"
+		}
 	default:
 		tag = "UPDATE"
 	}
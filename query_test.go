@@ -0,0 +1,338 @@
+package pgsrv
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/binary"
+	"github.com/jackc/pgx/pgproto3"
+	parser "github.com/lfittl/pg_query_go"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuery_Transaction(t *testing.T) {
+	run := func(t *testing.T, transport *protocol.Transport, sql string) {
+		sess := &session{Server: &server{queryer: &mockQueryer{}}}
+		err := sess.newQuery(transport, sql).Run(sess)
+		require.NoError(t, err)
+	}
+
+	t.Run("begins and commits", func(t *testing.T) {
+		transport := protocol.NewTransport(&bytes.Buffer{})
+		run(t, transport, "BEGIN")
+		require.Equal(t, protocol.TransactionInBlock, transport.TransactionStatus())
+		run(t, transport, "SELECT 1")
+		require.Equal(t, protocol.TransactionInBlock, transport.TransactionStatus())
+		run(t, transport, "COMMIT")
+		require.Equal(t, protocol.TransactionIdle, transport.TransactionStatus())
+	})
+	t.Run("fails on errors", func(t *testing.T) {
+		transport := protocol.NewTransport(&bytes.Buffer{})
+		run(t, transport, "START TRANSACTION")
+		run(t, transport, "DELETE FROM t")
+		require.Equal(t, protocol.TransactionInFailedBlock, transport.TransactionStatus())
+		run(t, transport, "SELECT 1")
+		require.Equal(t, protocol.TransactionInFailedBlock, transport.TransactionStatus())
+		run(t, transport, "ROLLBACK TO SAVEPOINT sp")
+		require.Equal(t, protocol.TransactionInBlock, transport.TransactionStatus())
+		run(t, transport, "ROLLBACK")
+		require.Equal(t, protocol.TransactionIdle, transport.TransactionStatus())
+	})
+	t.Run("errors outside of transaction blocks", func(t *testing.T) {
+		transport := protocol.NewTransport(&bytes.Buffer{})
+		run(t, transport, "DELETE FROM t")
+		require.Equal(t, protocol.TransactionIdle, transport.TransactionStatus())
+	})
+}
+
+func TestTagger_Tag(t *testing.T) {
+	for sql, expected := range map[string]string{
+		"BEGIN":                    "BEGIN",
+		"START TRANSACTION":        "START TRANSACTION",
+		"COMMIT":                   "COMMIT",
+		"ROLLBACK":                 "ROLLBACK",
+		"SAVEPOINT sp":             "SAVEPOINT",
+		"RELEASE SAVEPOINT sp":     "RELEASE",
+		"ROLLBACK TO SAVEPOINT sp": "ROLLBACK",
+	} {
+		tree, err := parser.Parse(sql)
+		require.NoError(t, err)
+		tag, err := (&tagger{Node: unwrapStmt(tree.Statements[0])}).Tag()
+		require.NoError(t, err)
+		require.Equal(t, expected, tag, sql)
+	}
+}
+
+// mockCancelQueryer blocks queries of pg_sleep until they're canceled, and
+// streams the rows of generate_series until they're canceled. Both signal
+// started once they're running.
+type mockCancelQueryer struct {
+	mockQueryer
+	started chan struct{}
+}
+
+func (r *mockCancelQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	sql := QueryFromContext(ctx)
+	switch {
+	case strings.Contains(sql, "pg_sleep"):
+		r.started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case strings.Contains(sql, "generate_series"):
+		return &mockEndlessRows{started: r.started}, nil
+	default:
+		return r.mockQueryer.Query(ctx, n)
+	}
+}
+
+// mockEndlessRows returns rows until it's closed
+type mockEndlessRows struct {
+	mockRows
+	started chan struct{}
+}
+
+func (r *mockEndlessRows) Next(dest []driver.Value) error {
+	if r.pos == 0 {
+		r.started <- struct{}{}
+		r.pos++
+	}
+
+	time.Sleep(time.Millisecond)
+	dest[0] = "row"
+	return nil
+}
+
+func TestSession_cancelRequest(t *testing.T) {
+	queryer := &mockCancelQueryer{started: make(chan struct{}, 1)}
+	srv := New(queryer).(*server)
+	connect := func() net.Conn {
+		f, b := loopbackPipe(t)
+		go srv.Serve(b)
+		return f
+	}
+
+	conn := connect()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	frontend, err := pgproto3.NewFrontend(conn, conn)
+	require.NoError(t, err)
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	})
+	require.NoError(t, err)
+
+	// receive returns the messages up to the next ReadyForQuery
+	var pid, secret uint32
+	receive := func(t *testing.T) []pgproto3.BackendMessage {
+		var msgs []pgproto3.BackendMessage
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			switch v := msg.(type) {
+			case *pgproto3.BackendKeyData:
+				pid, secret = v.ProcessID, v.SecretKey
+			case *pgproto3.ReadyForQuery:
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	receive(t)
+
+	// cancel sends a CancelRequest of the session on a new connection
+	cancel := func(t *testing.T) {
+		c := connect()
+		defer c.Close()
+
+		msg := make([]byte, 16)
+		binary.BigEndian.PutUint32(msg, 16)
+		binary.BigEndian.PutUint32(msg[4:], 80877102) // 1234.5678
+		binary.BigEndian.PutUint32(msg[8:], pid)
+		binary.BigEndian.PutUint32(msg[12:], secret)
+		_, err := c.Write(msg)
+		require.NoError(t, err)
+	}
+
+	t.Run("cancels the backend", func(t *testing.T) {
+		err := frontend.Send(&pgproto3.Query{String: "SELECT pg_sleep(10); SELECT 2"})
+		require.NoError(t, err)
+		<-queryer.started
+		cancel(t)
+
+		msgs := receive(t)
+		require.Len(t, msgs, 1, "expected the following statements to be canceled")
+		require.Equal(t, "57014", msgs[0].(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "canceling statement due to user request", msgs[0].(*pgproto3.ErrorResponse).Message)
+	})
+	t.Run("aborts row streaming", func(t *testing.T) {
+		err := frontend.Send(&pgproto3.Query{String: "SELECT * FROM generate_series(1, 10)"})
+		require.NoError(t, err)
+		<-queryer.started
+		cancel(t)
+
+		msgs := receive(t)
+		require.IsType(t, &pgproto3.RowDescription{}, msgs[0])
+		require.IsType(t, &pgproto3.DataRow{}, msgs[1])
+		require.Equal(t, "57014", msgs[len(msgs)-1].(*pgproto3.ErrorResponse).Code)
+	})
+	t.Run("doesn't cancel the following queries", func(t *testing.T) {
+		err := frontend.Send(&pgproto3.Query{String: "SELECT 1"})
+		require.NoError(t, err)
+
+		msgs := receive(t)
+		require.Len(t, msgs, 3)
+		require.IsType(t, &pgproto3.CommandComplete{}, msgs[2])
+	})
+}
+
+// mockCtxQueryer records the context of its query, and returns rows that
+// cancel the session's running query once their second row is read
+type mockCtxQueryer struct {
+	mockQueryer
+	sess *session
+	ctx  context.Context
+	rows *mockCancelingRows
+}
+
+func (r *mockCtxQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	r.ctx = ctx
+	r.rows = &mockCancelingRows{mockRows: mockRows{rows: 3}, queryer: r}
+	return r.rows, nil
+}
+
+type mockCancelingRows struct {
+	mockRows
+	queryer  *mockCtxQueryer
+	canceled bool // the cancel reached the context of the rows
+}
+
+func (r *mockCancelingRows) Next(dest []driver.Value) error {
+	if r.pos == 1 {
+		r.queryer.sess.cancel()
+		r.canceled = r.queryer.ctx.Err() != nil
+	}
+	return r.mockRows.Next(dest)
+}
+
+func TestSession_queryCtx(t *testing.T) {
+	queryer := &mockCtxQueryer{}
+	sess := &session{
+		Server:       &server{queryer: queryer},
+		stmts:        map[string]*nodes.PrepareStmt{},
+		pendingStmts: map[string]*nodes.PrepareStmt{},
+		portals:      map[string]*portal{},
+	}
+	queryer.sess = sess
+	buf := &bytes.Buffer{}
+	transport := protocol.NewTransport(buf)
+	frontend, err := pgproto3.NewFrontend(buf, nil)
+	require.NoError(t, err)
+	handle := func(t *testing.T, msg pgproto3.FrontendMessage) {
+		require.NoError(t, sess.handleFrontendMessage(transport, msg))
+	}
+
+	t.Run("releases the contexts of finished queries", func(t *testing.T) {
+		handle(t, &pgproto3.Query{String: "SELECT 1"})
+		require.Equal(t, context.Canceled, queryer.ctx.Err())
+		require.Nil(t, sess.CancelFunc)
+	})
+	t.Run("resumes portals with their own contexts", func(t *testing.T) {
+		buf.Reset()
+		handle(t, &pgproto3.Parse{Query: "SELECT 1"})
+		handle(t, &pgproto3.Bind{})
+		handle(t, &pgproto3.Execute{MaxRows: 1})
+		require.NoError(t, queryer.ctx.Err(), "expected the portal to keep the context of its rows")
+		require.Nil(t, sess.CancelFunc)
+
+		handle(t, &pgproto3.Execute{})
+		require.True(t, queryer.rows.canceled, "expected the resumed execution to cancel the context of the rows")
+		require.Nil(t, sess.portals[""].rows)
+
+		var msgs []pgproto3.BackendMessage
+		for {
+			msg, err := frontend.Receive()
+			if err != nil {
+				break
+			}
+			if _, ok := msg.(*pgproto3.DataRow); !ok {
+				msgs = append(msgs, msg)
+			}
+		}
+		require.IsType(t, &pgproto3.PortalSuspended{}, msgs[2])
+		require.Equal(t, "57014", msgs[3].(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, context.Canceled, queryer.ctx.Err())
+	})
+}
+
+// mockTypedRows returns a single row of an int4 and a NULL text column
+type mockTypedRows struct {
+	mockRows
+}
+
+func (r *mockTypedRows) Columns() []string { return []string{"a", "b"} }
+func (r *mockTypedRows) ColumnTypeDatabaseTypeName(index int) string {
+	return []string{"INT4", "TEXT"}[index]
+}
+func (r *mockTypedRows) Next(dest []driver.Value) error {
+	if r.pos >= r.rows {
+		return io.EOF
+	}
+
+	dest[0], dest[1] = int64(42), nil
+	r.pos++
+	return nil
+}
+
+func TestQuery_writeRows(t *testing.T) {
+	write := func(t *testing.T, formats []int16) []pgproto3.BackendMessage {
+		buf := &bytes.Buffer{}
+		frontend, _ := pgproto3.NewFrontend(buf, nil)
+		sess := &session{Server: &server{queryer: &mockQueryer{}}}
+		q := sess.newQuery(protocol.NewTransport(buf), "")
+
+		done, err := q.writeRows(&mockTypedRows{mockRows{rows: 1}}, formats, 0)
+		require.True(t, done)
+		if err != nil {
+			// errors are returned to be reported by the caller
+			require.NoError(t, q.writeError(err))
+		}
+
+		var msgs []pgproto3.BackendMessage
+		for {
+			msg, err := frontend.Receive()
+			if err != nil {
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	t.Run("text format", func(t *testing.T) {
+		msgs := write(t, nil)
+		require.Len(t, msgs, 2)
+		require.Equal(t, [][]byte{[]byte("42"), nil}, msgs[0].(*pgproto3.DataRow).Values)
+	})
+	t.Run("binary format", func(t *testing.T) {
+		msgs := write(t, []int16{1})
+		require.Len(t, msgs, 2)
+		require.Equal(t, [][]byte{{0, 0, 0, 42}, nil}, msgs[0].(*pgproto3.DataRow).Values)
+	})
+	t.Run("mixed formats", func(t *testing.T) {
+		msgs := write(t, []int16{0, 1})
+		require.Len(t, msgs, 2)
+		require.Equal(t, []byte("42"), msgs[0].(*pgproto3.DataRow).Values[0])
+	})
+	t.Run("fails on wrong number of formats", func(t *testing.T) {
+		msgs := write(t, []int16{0, 1, 1})
+		require.Len(t, msgs, 1)
+		require.Equal(t, "08P01", msgs[0].(*pgproto3.ErrorResponse).Code)
+	})
+}
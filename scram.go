@@ -0,0 +1,356 @@
+package pgsrv
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgx/pgio"
+	"github.com/panoplyio/pgsrv/protocol"
+	"strconv"
+	"strings"
+)
+
+// scramSHA256 is the name of the only supported SASL mechanism
+const scramSHA256 = "SCRAM-SHA-256"
+
+// scramIterations is the iteration count of the verifiers created by
+// SCRAMVerifier, just like the default of Postgres
+const scramIterations = 4096
+
+// scramSaltLen is the length of the salts of the verifiers created by
+// SCRAMVerifier, and of the mock verifiers of unknown users
+const scramSaltLen = 16
+
+// scramAuthenticator requests and verifies a SCRAM-SHA-256 proof of the
+// password from the client, by the SASL exchange described in RFC 5802 and
+// RFC 7677. Channel binding isn't supported.
+//
+// It requires a passwordProvider implementation that provides the SCRAM
+// verifiers of the users (see SCRAMVerifier), rather than their passwords.
+type scramAuthenticator struct {
+	pp         PasswordProvider
+	mockSecret []byte // derives the salts of the mock verifiers of unknown users
+}
+
+func newSCRAMAuthenticator(pp PasswordProvider) *scramAuthenticator {
+	return &scramAuthenticator{pp: pp, mockSecret: randomBytes(32)}
+}
+
+func (a *scramAuthenticator) Authenticate(rw protocol.MessageReadWriter, client *Client) error {
+	fail := func(err error) error { return failAuthentication(rw, err) }
+
+	err := rw.Write(authSASLMsg(scramSHA256))
+	if err != nil {
+		return err
+	}
+
+	m, err := rw.Read()
+	if err != nil {
+		return err
+	}
+	if m.Type() != 'p' {
+		return fail(ProtocolViolation(fmt.Sprintf(errExpectedPassword, m.Type())))
+	}
+
+	mechanism, clientFirst, err := parseSASLInitialResponse(m)
+	if err != nil {
+		return fail(err)
+	}
+	if mechanism != scramSHA256 {
+		return fail(ProtocolViolation("client selected an invalid SASL authentication mechanism"))
+	}
+
+	clientFirstBare, clientNonce, err := parseSCRAMClientFirst(clientFirst)
+	if err != nil {
+		return fail(err)
+	}
+
+	// unknown users go through the exchange with a mock verifier, which fails
+	// just like a wrong password does
+	user, _ := client.Args["user"].(string)
+	stored, err := a.pp.GetPassword(user)
+	v, ok := parseSCRAMVerifier(stored)
+	if err != nil || !ok {
+		v = a.mockVerifier(user)
+		ok = false
+	}
+
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(randomBytes(18))
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(v.salt), v.iterations)
+	err = rw.Write(authSASLContinueMsg(serverFirst))
+	if err != nil {
+		return err
+	}
+
+	m, err = rw.Read()
+	if err != nil {
+		return err
+	}
+	if m.Type() != 'p' {
+		return fail(ProtocolViolation(fmt.Sprintf(errExpectedPassword, m.Type())))
+	}
+
+	clientFinalWithoutProof, proof, err := parseSCRAMClientFinal(string(m[5:]), clientFirst[:len(clientFirst)-len(clientFirstBare)], nonce)
+	if err != nil {
+		return fail(err)
+	}
+
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	if !v.verifyProof(proof, authMessage) || !ok {
+		return fail(InvalidPassword(user))
+	}
+
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(v.serverKey, authMessage))
+	err = rw.Write(authSASLFinalMsg(serverFinal))
+	if err != nil {
+		return err
+	}
+
+	return rw.Write(authOKMsg())
+}
+
+// mockVerifier returns the verifier of an unknown user. Just like in Postgres,
+// its salt is derived from the user name and a secret of the server, so that
+// like the salt of a real verifier, it's the same on every attempt. Its keys
+// are random, as no proof is ever accepted, which spares the key derivation
+// that would take longer than parsing the verifier of a known user does.
+func (a *scramAuthenticator) mockVerifier(user string) *scramVerifier {
+	return &scramVerifier{
+		iterations: scramIterations,
+		salt:       scramHMAC(a.mockSecret, user)[:scramSaltLen],
+		storedKey:  randomBytes(sha256.Size),
+		serverKey:  randomBytes(sha256.Size),
+	}
+}
+
+// SCRAMVerifier creates the SCRAM-SHA-256 verifier of the password, with a
+// random salt, in the format of pg_authid:
+//
+//	SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+//
+// PasswordProviders of the SCRAMSHA256 type return these verifiers rather than
+// the passwords themselves.
+func SCRAMVerifier(password string) []byte {
+	v := newSCRAMVerifier(randomBytes(scramSaltLen), []byte(password), scramIterations)
+	return []byte(fmt.Sprintf("%s$%d:%s$%s:%s",
+		scramSHA256,
+		v.iterations,
+		base64.StdEncoding.EncodeToString(v.salt),
+		base64.StdEncoding.EncodeToString(v.storedKey),
+		base64.StdEncoding.EncodeToString(v.serverKey),
+	))
+}
+
+// scramVerifier is the stored form of a password, which can verify proofs of
+// the password without knowing it
+type scramVerifier struct {
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func newSCRAMVerifier(salt, password []byte, iterations int) *scramVerifier {
+	salted := scramHi(password, salt, iterations)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &scramVerifier{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  scramHMAC(salted, "Server Key"),
+	}
+}
+
+// parseSCRAMVerifier parses a verifier in the format of pg_authid
+func parseSCRAMVerifier(b []byte) (*scramVerifier, bool) {
+	parts := strings.Split(string(b), "$")
+	if len(parts) != 3 || parts[0] != scramSHA256 {
+		return nil, false
+	}
+
+	params := strings.Split(parts[1], ":")
+	keys := strings.Split(parts[2], ":")
+	if len(params) != 2 || len(keys) != 2 {
+		return nil, false
+	}
+
+	iterations, err := strconv.Atoi(params[0])
+	if err != nil || iterations < 1 {
+		return nil, false
+	}
+	salt, err := base64.StdEncoding.DecodeString(params[1])
+	if err != nil {
+		return nil, false
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(keys[0])
+	if err != nil || len(storedKey) != sha256.Size {
+		return nil, false
+	}
+	serverKey, err := base64.StdEncoding.DecodeString(keys[1])
+	if err != nil || len(serverKey) != sha256.Size {
+		return nil, false
+	}
+
+	v := &scramVerifier{iterations: iterations, salt: salt, storedKey: storedKey, serverKey: serverKey}
+	return v, true
+}
+
+// verifyProof verifies the client's proof of the password, which is its
+// ClientKey masked by the signature of the exchanged messages
+func (v *scramVerifier) verifyProof(proof []byte, authMessage string) bool {
+	signature := scramHMAC(v.storedKey, authMessage)
+	if len(proof) != len(signature) {
+		return false
+	}
+
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ signature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	return hmac.Equal(storedKey[:], v.storedKey)
+}
+
+// parseSASLInitialResponse parses the mechanism selected by the client and its
+// initial response from a SASLInitialResponse message
+func parseSASLInitialResponse(m protocol.Message) (mechanism, response string, err error) {
+	body := m[5:]
+	idx := bytes.IndexByte(body, 0)
+	if idx == -1 || len(body) < idx+5 {
+		return "", "", ProtocolViolation("malformed SASLInitialResponse message")
+	}
+
+	mechanism = string(body[:idx])
+	length := int32(binary.BigEndian.Uint32(body[idx+1:]))
+	data := body[idx+5:]
+	if length < 0 || int(length) != len(data) {
+		return "", "", ProtocolViolation("malformed SASLInitialResponse message")
+	}
+	return mechanism, string(data), nil
+}
+
+// parseSCRAMClientFirst parses the client-first-message, and returns its bare
+// part, following the GS2 header, and the client's nonce
+func parseSCRAMClientFirst(msg string) (bare, nonce string, err error) {
+	malformed := ProtocolViolation(fmt.Sprintf("malformed SCRAM message: \"%s\"", msg))
+
+	// the GS2 header is a channel binding flag and an authorization identity
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return "", "", malformed
+	}
+	switch {
+	case parts[0] == "n", parts[0] == "y":
+	case strings.HasPrefix(parts[0], "p="):
+		return "", "", ProtocolViolation("channel binding is not supported")
+	default:
+		return "", "", malformed
+	}
+	if parts[1] != "" {
+		return "", "", Unsupported("authorization identities")
+	}
+
+	// the user name is ignored in favor of the one of the startup message
+	bare = parts[2]
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return "", "", malformed
+	}
+	return bare, attrs[1][2:], nil
+}
+
+// parseSCRAMClientFinal parses the client-final-message, and returns it
+// without the proof, along with the decoded proof. The message must repeat the
+// GS2 header and the nonce of the exchange.
+func parseSCRAMClientFinal(msg, gs2Header, nonce string) (withoutProof string, proof []byte, err error) {
+	malformed := ProtocolViolation(fmt.Sprintf("malformed SCRAM message: \"%s\"", msg))
+
+	idx := strings.LastIndex(msg, ",p=")
+	if idx == -1 {
+		return "", nil, malformed
+	}
+	withoutProof = msg[:idx]
+	proof, err = base64.StdEncoding.DecodeString(msg[idx+3:])
+	if err != nil {
+		return "", nil, malformed
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return "", nil, malformed
+	}
+	if attrs[0][2:] != base64.StdEncoding.EncodeToString([]byte(gs2Header)) {
+		return "", nil, ProtocolViolation("SCRAM channel binding check failed")
+	}
+	if attrs[1][2:] != nonce {
+		return "", nil, ProtocolViolation("SCRAM nonce mismatch")
+	}
+	return withoutProof, proof, nil
+}
+
+// scramHi is the PBKDF2 function of HMAC-SHA-256 with a single block of output
+func scramHi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(nil)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// randomBytes returns a cryptographically secure random slice of n bytes.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// authSASLMsg returns a message that requests SASL authentication by one of
+// the provided mechanisms
+func authSASLMsg(mechanisms ...string) protocol.Message {
+	msg := protocol.Message{'R', 0, 0, 0, 0, 0, 0, 0, 10}
+	for _, m := range mechanisms {
+		msg = append(append(msg, m...), 0)
+	}
+	msg = append(msg, 0)
+	binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+	return msg
+}
+
+// authSASLContinueMsg returns a message with the server's challenge
+func authSASLContinueMsg(data string) protocol.Message {
+	return authSASLDataMsg(11, data)
+}
+
+// authSASLFinalMsg returns a message with the server's outcome of SASL
+// authentication
+func authSASLFinalMsg(data string) protocol.Message {
+	return authSASLDataMsg(12, data)
+}
+
+func authSASLDataMsg(authType int32, data string) protocol.Message {
+	msg := protocol.Message{'R'}
+	msg = pgio.AppendInt32(msg, int32(8+len(data)))
+	msg = pgio.AppendInt32(msg, authType)
+	return append(msg, data...)
+}
@@ -0,0 +1,212 @@
+package pgsrv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/jackc/pgx/pgio"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scramPasswordProvider provides the SCRAM verifiers of a constant password
+type scramPasswordProvider struct {
+	verifier []byte
+}
+
+func (pp *scramPasswordProvider) Type() AuthType {
+	return SCRAMSHA256
+}
+
+func (pp *scramPasswordProvider) GetPassword(user string) ([]byte, error) {
+	return pp.verifier, nil
+}
+
+func TestSCRAMVerifier(t *testing.T) {
+	verifier := SCRAMVerifier("test")
+	require.True(t, strings.HasPrefix(string(verifier), "SCRAM-SHA-256$4096:"))
+
+	v, ok := parseSCRAMVerifier(verifier)
+	require.True(t, ok)
+	require.Equal(t, 4096, v.iterations)
+	require.Len(t, v.salt, 16)
+	require.Equal(t, newSCRAMVerifier(v.salt, []byte("test"), 4096), v)
+
+	_, ok = parseSCRAMVerifier([]byte("md5abc"))
+	require.False(t, ok)
+	_, ok = parseSCRAMVerifier([]byte("SCRAM-SHA-256$4096:c2FsdA==$a2V5:a2V5"))
+	require.False(t, ok)
+}
+
+func TestScramVerifier_verifyProof(t *testing.T) {
+	// SCRAM-SHA-256 test vector of RFC 7677
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	v := newSCRAMVerifier(salt, []byte("pencil"), 4096)
+	nonce := "rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=" + nonce + ",s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=" + nonce
+
+	proof, _ := base64.StdEncoding.DecodeString("dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	require.True(t, v.verifyProof(proof, authMessage))
+	require.Equal(t, "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", base64.StdEncoding.EncodeToString(scramHMAC(v.serverKey, authMessage)))
+
+	proof[0]++
+	require.False(t, v.verifyProof(proof, authMessage))
+}
+
+func TestScramHi(t *testing.T) {
+	// PBKDF2-HMAC-SHA256 test vector of RFC 7914
+	expected := []byte{
+		0x55, 0xac, 0x04, 0x6e, 0x56, 0xe3, 0x08, 0x9f, 0xec, 0x16, 0x91, 0xc2, 0x25, 0x44, 0xb6, 0x05,
+		0xf9, 0x41, 0x85, 0x21, 0x6d, 0xde, 0x04, 0x65, 0xe6, 0x8b, 0x9d, 0x57, 0xc2, 0x0d, 0xac, 0xbc,
+	}
+	require.Equal(t, expected, scramHi([]byte("passwd"), []byte("salt"), 1))
+}
+
+func TestScramAuthenticator_Authenticate(t *testing.T) {
+	args := map[string]interface{}{
+		"user": "postgres",
+	}
+	a := newSCRAMAuthenticator(&scramPasswordProvider{verifier: SCRAMVerifier("test")})
+
+	t.Run("valid password", func(t *testing.T) {
+		rw := &mockSCRAMMessageReadWriter{pass: "test", gs2Header: "n,,"}
+		err := a.Authenticate(rw, &Client{Args: args})
+
+		require.NoError(t, err)
+		require.Equal(t, authSASLMsg("SCRAM-SHA-256"), rw.messages[0])
+		require.Equal(t, protocol.Message{'R', 0, 0, 0, 54, 0, 0, 0, 12}, rw.messages[2][:9])
+		require.Equal(t, "v="+base64.StdEncoding.EncodeToString(rw.serverSignature), string(rw.messages[2][9:]))
+		require.Equal(t, authOKMessage, rw.messages[3])
+	})
+
+	t.Run("invalid password", func(t *testing.T) {
+		rw := &mockSCRAMMessageReadWriter{pass: "shtoot", gs2Header: "n,,"}
+		err := a.Authenticate(rw, &Client{Args: args})
+
+		require.Len(t, rw.messages, 3)
+		require.True(t, bytes.Contains(rw.messages[2], fatalMarker))
+		require.EqualError(t, err, "password authentication failed for user \"postgres\"")
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		a := newSCRAMAuthenticator(&failingPasswordProvider{authType: SCRAMSHA256})
+		rw := &mockSCRAMMessageReadWriter{pass: "test", gs2Header: "n,,"}
+		err := a.Authenticate(rw, &Client{Args: args})
+
+		require.Len(t, rw.messages, 3, "expected the exchange to complete")
+		require.EqualError(t, err, "password authentication failed for user \"postgres\"")
+
+		// the salt is the same on every attempt, like the salt of a real user
+		again := &mockSCRAMMessageReadWriter{pass: "test", gs2Header: "n,,"}
+		a.Authenticate(again, &Client{Args: args})
+		require.Equal(t, scramSalt(rw.serverFirst), scramSalt(again.serverFirst))
+		require.Len(t, scramSalt(rw.serverFirst), scramSaltLen)
+
+		other := &mockSCRAMMessageReadWriter{pass: "test", gs2Header: "n,,"}
+		a.Authenticate(other, &Client{Args: map[string]interface{}{"user": "other"}})
+		require.NotEqual(t, scramSalt(rw.serverFirst), scramSalt(other.serverFirst))
+	})
+
+	t.Run("channel binding", func(t *testing.T) {
+		rw := &mockSCRAMMessageReadWriter{pass: "test", gs2Header: "p=tls-server-end-point,,"}
+		err := a.Authenticate(rw, &Client{Args: args})
+
+		require.Len(t, rw.messages, 2)
+		require.True(t, bytes.Contains(rw.messages[1], fatalMarker))
+		require.Equal(t, "08P01", fromErr(err).Code())
+	})
+
+	t.Run("invalid mechanism", func(t *testing.T) {
+		rw := &mockSCRAMMessageReadWriter{mechanism: "SCRAM-SHA-256-PLUS", gs2Header: "n,,"}
+		err := a.Authenticate(rw, &Client{Args: args})
+
+		require.Len(t, rw.messages, 2)
+		require.EqualError(t, err, "client selected an invalid SASL authentication mechanism")
+	})
+}
+
+// scramSalt returns the decoded salt of the server-first-message
+func scramSalt(serverFirst string) []byte {
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if strings.HasPrefix(attr, "s=") {
+			salt, _ := base64.StdEncoding.DecodeString(attr[2:])
+			return salt
+		}
+	}
+	return nil
+}
+
+// mockSCRAMMessageReadWriter implements messageReadWriter and acts as a client
+// of the SCRAM-SHA-256 exchange, which proves it knows the password
+type mockSCRAMMessageReadWriter struct {
+	pass            string
+	mechanism       string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	serverSignature []byte
+	messages        []protocol.Message
+}
+
+func (rw *mockSCRAMMessageReadWriter) Read() (protocol.Message, error) {
+	if rw.serverFirst == "" {
+		mechanism := rw.mechanism
+		if mechanism == "" {
+			mechanism = "SCRAM-SHA-256"
+		}
+
+		// SASLInitialResponse
+		rw.clientFirstBare = "n=,r=rOprNGfwEbeRWgbNEkqO"
+		data := rw.gs2Header + rw.clientFirstBare
+		msg := protocol.Message{'p', 0, 0, 0, 0}
+		msg = append(append(msg, mechanism...), 0)
+		msg = pgio.AppendInt32(msg, int32(len(data)))
+		msg = append(msg, data...)
+		binary.BigEndian.PutUint32(msg[1:5], uint32(len(msg)-1))
+		return msg, nil
+	}
+
+	// SASLResponse, with the proof of the password for the server's challenge
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(rw.serverFirst, ",") {
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	decodedSalt, _ := base64.StdEncoding.DecodeString(salt)
+	salted := scramHi([]byte(rw.pass), decodedSalt, iterations)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(rw.gs2Header)) + ",r=" + nonce
+	authMessage := rw.clientFirstBare + "," + rw.serverFirst + "," + withoutProof
+	signature := scramHMAC(storedKey[:], authMessage)
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	rw.serverSignature = scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+
+	data := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)
+	msg := pgio.AppendInt32(protocol.Message{'p'}, int32(4+len(data)))
+	return append(msg, data...), nil
+}
+
+func (rw *mockSCRAMMessageReadWriter) Write(m protocol.Message) error {
+	if len(m) > 9 && m[0] == 'R' && binary.BigEndian.Uint32(m[5:9]) == 11 {
+		rw.serverFirst = string(m[9:])
+	}
+	rw.messages = append(rw.messages, m)
+	return nil
+}
@@ -2,6 +2,7 @@ package pgsrv
 
 import (
 	"context"
+	"database/sql/driver"
 	"fmt"
 	"github.com/jackc/pgx/pgproto3"
 	"github.com/jackc/pgx/pgtype"
@@ -10,15 +11,38 @@ import (
 	"github.com/panoplyio/pgsrv/protocol"
 	"io"
 	"math/rand"
-	"strings"
+	"net"
 	"sync"
+	"time"
 )
 
 var allSessions sync.Map
 
 type portal struct {
+	name                 string
 	srcPreparedStatement string
+	stmt                 *nodes.PrepareStmt
+	query                nodes.Node          // stmt's query with the parameters bound
+	args                 []driver.NamedValue // the parameters, for backends that bind them
 	parameters           [][]byte
+	formats              []int16            // the result format codes
+	rows                 driver.Rows        // open cursor of a partially consumed portal
+	ctx                  context.Context    // the context the open cursor is bound to
+	cancel               context.CancelFunc // cancels ctx once the cursor is closed
+	done                 bool               // portal ran to completion
+}
+
+// close releases the portal's open cursor, if there's any
+func (p *portal) close() (err error) {
+	if p.rows != nil {
+		err = p.rows.Close()
+		p.rows = nil
+	}
+	if p.cancel != nil {
+		p.cancel()
+		p.ctx, p.cancel = nil, nil
+	}
+	return
 }
 
 // Session represents a single client-connection, and handles all of the
@@ -27,26 +51,41 @@ type portal struct {
 // see: https://www.postgresql.org/docs/9.2/static/protocol.html
 // for postgres protocol and startup handshake process
 type session struct {
-	Server       *server
-	Conn         io.ReadWriteCloser
-	ConnInfo     *pgtype.ConnInfo
-	Args         map[string]interface{}
-	Secret       int32 // used for cancelling requests
-	Ctx          context.Context
-	CancelFunc   context.CancelFunc
-	initialized  bool
-	stmts        map[string]*nodes.PrepareStmt
-	pendingStmts map[string]*nodes.PrepareStmt
-	portals      map[string]*portal
+	Server        *server
+	Conn          io.ReadWriteCloser
+	ConnInfo      *pgtype.ConnInfo
+	Args          map[string]interface{}
+	Secret        int32 // used for cancelling requests
+	pid           int32 // identifies the session to cancel requests, zero until registered
+	Ctx           context.Context
+	CancelFunc    context.CancelFunc // cancels the running query
+	mu            sync.Mutex         // guards CancelFunc, called by cancel requests
+	initialized   bool
+	stmts         map[string]*nodes.PrepareStmt
+	pendingStmts  map[string]*nodes.PrepareStmt
+	portals       map[string]*portal
+	tx            Tx                       // open transaction block of a Transactor
+	timeouts      map[string]time.Duration // timeout settings SET by the session
+	localTimeouts map[string]time.Duration // timeout settings SET LOCAL in the transaction block
+	savedTimeouts map[string]time.Duration // timeout settings before the block's first SET, nil if none
 }
 
 func (s *session) startUp() error {
 	handshake := protocol.NewHandshake(s.Conn)
+	if conn, ok := s.Conn.(net.Conn); ok && s.Server.tlsConfig != nil {
+		handshake = protocol.NewTLSHandshake(conn, s.Server.tlsConfig)
+	}
+
 	msg, err := handshake.Init()
 	if err != nil {
 		return err
 	}
 
+	// the rest of the session communicates over TLS, once it's established
+	if tlsConn := handshake.TLSConn(); tlsConn != nil {
+		s.Conn = tlsConn
+	}
+
 	if msg.IsCancel() {
 		pid, secret, err := msg.CancelKeyData()
 		if err != nil {
@@ -58,58 +97,102 @@ func (s *session) startUp() error {
 			_, cancelFunc := context.WithCancel(context.Background())
 			cancelFunc()
 		} else if s.(*session).Secret == secret {
-			s.(*session).CancelFunc() // intentionally doesn't report success to frontend
+			s.(*session).cancel() // intentionally doesn't report success to frontend
 		}
 
 		return nil // disconnect.
 	}
 
+	if s.Server.tlsRequired && handshake.TLSConn() == nil {
+		err = InvalidAuthorizationSpecification("SSL connection is required")
+		handshake.Write(protocol.ErrorResponse(err))
+		return err
+	}
+
 	s.Args, err = msg.StartupArgs()
 	if err != nil {
 		return err
 	}
 
+	if user, _ := s.Args["user"].(string); user == "" {
+		err = InvalidAuthorizationSpecification("no PostgreSQL user name specified in startup packet")
+		handshake.Write(protocol.ErrorResponse(err))
+		return err
+	}
+
 	// handle authentication
-	err = s.Server.authenticator.authenticate(handshake, s.Args)
+	client := &Client{Args: s.Args}
+	if conn, ok := s.Conn.(net.Conn); ok {
+		client.RemoteAddr = conn.RemoteAddr()
+	}
+	if tlsConn := handshake.TLSConn(); tlsConn != nil {
+		state := tlsConn.ConnectionState()
+		client.TLS = &state
+	}
+
+	err = s.Server.authenticator.Authenticate(handshake, client)
 	if err != nil {
 		return err
 	}
 
+	err = s.validateTimeouts()
+	if err != nil {
+		err = WithSeverity(fromErr(err), fatalSeverity)
+		handshake.Write(protocol.ErrorResponse(err))
+		return err
+	}
+
 	err = handshake.Write(protocol.ParameterStatus("client_encoding", "utf8"))
 	if err != nil {
 		return err
 	}
 
-	// generate cancellation pid and secret for this session
+	// generate cancellation pid and secret for this session. the session is
+	// registered under a pid that isn't used by any other session, until it's
+	// closed by Serve.
 	s.Secret = rand.Int31()
-
-	pid := rand.Int31()
-	for s1, ok := allSessions.Load(pid); ok && s1 != nil; pid++ {
-		s1, ok = allSessions.Load(pid)
+	for s.pid == 0 {
+		if pid := rand.Int31(); pid != 0 {
+			if _, used := allSessions.LoadOrStore(pid, s); !used {
+				s.pid = pid
+			}
+		}
 	}
 
-	allSessions.Store(pid, s)
-	defer allSessions.Delete(pid)
+	// queries are canceled by their own contexts, derived from the session's
+	s.Ctx = context.Background()
 
 	// notify the client of the pid and secret to be passed back when it wishes
 	// to interrupt this session
-	s.Ctx, s.CancelFunc = context.WithCancel(context.Background())
-	err = handshake.Write(protocol.BackendKeyData(pid, s.Secret))
+	err = handshake.Write(protocol.BackendKeyData(s.pid, s.Secret))
 	if err != nil {
 		return err
 	}
 
-	s.ConnInfo = pgtype.NewConnInfo()
-	for k, v := range protocol.TypesOid {
-		s.ConnInfo.RegisterDataType(pgtype.DataType{Name: strings.ToLower(k), OID: pgtype.OID(v), Value: &pgtype.GenericText{}})
+	s.ConnInfo = s.types().connInfo()
+	return nil
+}
+
+// types returns the registry of the data types supported by the session
+func (s *session) types() *Types {
+	if s.Server == nil || s.Server.types == nil {
+		return defaultTypes
 	}
+	return s.Server.types
+}
 
-	return nil
+// newConnInfo creates the pgtype registry of the built-in types
+func newConnInfo() *pgtype.ConnInfo {
+	return defaultTypes.connInfo()
 }
 
 // Handle a connection session
 func (s *session) Serve() error {
 	err := s.startUp()
+	if s.pid != 0 {
+		// cancel requests find the session for as long as it's connected
+		defer allSessions.Delete(s.pid)
+	}
 	if err != nil {
 		return err
 	}
@@ -117,12 +200,22 @@ func (s *session) Serve() error {
 	s.stmts = map[string]*nodes.PrepareStmt{}
 	s.pendingStmts = map[string]*nodes.PrepareStmt{}
 	s.portals = map[string]*portal{}
+	// the portals' cursors are closed before their transaction is rolled back
+	defer s.rollback()
+	defer s.closePortals()
 	t := protocol.NewTransport(s.Conn)
 
 	// query-cycle
 	for {
+		idleTimeout := s.armIdleTimeout(t.TransactionStatus())
 		msg, ts, err := t.NextFrontendMessage()
 		if err != nil {
+			if idleTimeout && isTimeoutErr(err) {
+				// written directly, as the transport might be holding the
+				// messages of an extended query
+				err = IdleInTransactionSessionTimeout()
+				s.Conn.Write(protocol.ErrorResponse(err))
+			}
 			return err
 		}
 
@@ -141,19 +234,23 @@ func (s *session) handleFrontendMessage(t *protocol.Transport, msg pgproto3.Fron
 		s.Conn.Close()
 		return nil // client terminated intentionally
 	case *pgproto3.Query:
-		q := &query{
-			transport: t,
-			sql:       v.String,
-			queryer:   s.Server,
-			execer:    s.Server,
-		}
+		q := s.newQuery(t, v.String)
 		err = q.Run(s)
+		s.release(q)
+
+		// simple query destroys the unnamed prepared statement and portal
+		delete(s.stmts, "")
+		s.closePortal("")
 	case *pgproto3.Describe:
-		res, err = s.describe(v)
+		res, err = s.describe(t, v)
 	case *pgproto3.Parse:
-		res, err = s.prepare(v)
+		res, err = s.prepare(t, v)
 	case *pgproto3.Bind:
-		res, err = s.bind(v)
+		res, err = s.bind(t, v)
+	case *pgproto3.Execute:
+		res, err = s.execute(t, v)
+	case *pgproto3.Close:
+		res, err = s.close(v)
 	case *pgproto3.Sync:
 	default:
 		res = append(res, protocol.ErrorResponse(Unsupported("message type")))
@@ -167,6 +264,103 @@ func (s *session) handleFrontendMessage(t *protocol.Transport, msg pgproto3.Fron
 	return
 }
 
+// newQuery creates a query to be executed by the session's server, using the
+// optional interfaces the server's queryer implements. Within a transaction
+// block of a Transactor, the queries are executed by its Tx instead. The
+// query's context must be released once it's done (see release).
+func (s *session) newQuery(t *protocol.Transport, sql string) *query {
+	ctx, cancel := s.queryCtx()
+	return s.queryWithCtx(t, sql, ctx, cancel)
+}
+
+// resumeQuery creates a query that resumes streaming the rows of a suspended
+// portal. The rows are bound to the context of the query that opened them, so
+// the query runs with that context, which is kept by the portal.
+func (s *session) resumeQuery(t *protocol.Transport, p *portal) *query {
+	q := s.queryWithCtx(t, "", p.ctx, p.cancel)
+	q.cancel = nil
+	return q
+}
+
+// queryWithCtx creates a query with the provided context, which is canceled by
+// the cancel requests for as long as the query runs
+func (s *session) queryWithCtx(t *protocol.Transport, sql string, ctx context.Context, cancel context.CancelFunc) *query {
+	backend := s.Server
+	if s.tx != nil {
+		// the server implementation adapts the Tx the same way it adapts queryers
+		backend = &server{queryer: s.tx}
+	}
+
+	connInfo := s.ConnInfo
+	if connInfo == nil {
+		connInfo = s.types().connInfo()
+	}
+
+	q := &query{
+		transport: t,
+		connInfo:  connInfo,
+		types:     s.types(),
+		ctx:       ctx,
+		cancel:    cancel,
+		sql:       sql,
+		queryer:   backend,
+		execer:    backend,
+	}
+	q.queryerWithArgs, _ = backend.queryer.(QueryerWithArgs)
+	q.execerWithArgs, _ = backend.queryer.(ExecerWithArgs)
+	q.describer, _ = backend.queryer.(Describer)
+	if q.describer == nil {
+		q.describer, _ = s.Server.queryer.(Describer)
+	}
+	q.transactor, _ = s.Server.queryer.(Transactor)
+	s.running(cancel)
+	return q
+}
+
+// queryCtx creates the context of a new query. It's a fresh cancellable
+// context derived from the session's, so that cancel requests only cancel the
+// query that is currently running. Its deadline is set by statement_timeout.
+func (s *session) queryCtx() (context.Context, context.CancelFunc) {
+	if timeout := s.timeout(statementTimeout); timeout > 0 {
+		return context.WithTimeout(s.sessionCtx(), timeout)
+	}
+	return context.WithCancel(s.sessionCtx())
+}
+
+// running routes the cancel requests to the cancel func of the running query,
+// or nowhere when it's nil
+func (s *session) running(cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.CancelFunc = cancel
+}
+
+// release releases the context of the query once it's done, unless it's kept
+// by a portal, which releases it once its rows are closed
+func (s *session) release(q *query) {
+	s.running(nil)
+	if q.cancel != nil {
+		q.cancel()
+	}
+}
+
+// sessionCtx returns the session's context, which outlives its queries
+func (s *session) sessionCtx() context.Context {
+	if s.Ctx == nil {
+		return context.Background()
+	}
+	return s.Ctx
+}
+
+// cancel cancels the running query, if any
+func (s *session) cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.CancelFunc != nil {
+		s.CancelFunc()
+	}
+}
+
 func (s *session) handleTransactionState(state protocol.TransactionState) {
 	switch state {
 	case protocol.InTransaction, protocol.NotInTransaction:
@@ -179,11 +373,27 @@ func (s *session) handleTransactionState(state protocol.TransactionState) {
 			}
 		}
 		s.pendingStmts = map[string]*nodes.PrepareStmt{}
-		s.portals = map[string]*portal{}
+		s.closePortals()
+	}
+}
+
+// closePortal releases and removes a single portal by its name
+func (s *session) closePortal(name string) {
+	if p, ok := s.portals[name]; ok {
+		p.close()
+		delete(s.portals, name)
 	}
 }
 
-func (s *session) prepare(parseMsg *pgproto3.Parse) (res []protocol.Message, err error) {
+// closePortals releases and removes all of the session's portals
+func (s *session) closePortals() {
+	for _, p := range s.portals {
+		p.close()
+	}
+	s.portals = map[string]*portal{}
+}
+
+func (s *session) prepare(t *protocol.Transport, parseMsg *pgproto3.Parse) (res []protocol.Message, err error) {
 	var tree parser.ParsetreeList
 	tree, err = parser.Parse(parseMsg.Query)
 	if err != nil {
@@ -191,24 +401,41 @@ func (s *session) prepare(parseMsg *pgproto3.Parse) (res []protocol.Message, err
 		return
 	}
 
-	ps := nodes.PrepareStmt{
-		Query:    tree.Statements[0],
-		Argtypes: nodes.List{Items: make([]nodes.Node, len(parseMsg.ParameterOIDs))},
+	if len(tree.Statements) > 1 {
+		res = append(res, protocol.ErrorResponse(SyntaxError("cannot insert multiple commands into a prepared statement")))
+		return
 	}
-	for i, p := range parseMsg.ParameterOIDs {
-		dt, ok := s.ConnInfo.DataTypeForOID(pgtype.OID(p))
-		if !ok {
-			res = append(res, protocol.ErrorResponse(fmt.Errorf("cache lookup failed for type %d", p)))
-			return
-		}
-		ps.Argtypes.Items[i] = nodes.TypeName{
-			TypeOid: nodes.Oid(p),
-			Names: nodes.List{
-				Items: []nodes.Node{
-					nodes.String{Str: dt.Name},
-				},
-			},
-		}
+
+	// an empty query is prepared as a statement without a query
+	var stmt nodes.Node
+	if len(tree.Statements) == 1 {
+		stmt = tree.Statements[0]
+	}
+
+	if aborted(t.TransactionStatus(), unwrapStmt(stmt)) {
+		res = append(res, protocol.ErrorResponse(InFailedSQLTransaction()))
+		return
+	}
+
+	// the parameter types may be described by the backend, which is canceled
+	// just like queries are
+	queryCtx, cancel := s.queryCtx()
+	s.running(cancel)
+	defer func() {
+		s.running(nil)
+		cancel()
+	}()
+
+	ctx := queryContext(queryCtx, s, parseMsg.Query, tree)
+	argtypes, typesErr := s.paramTypes(ctx, stmt, parseMsg.ParameterOIDs)
+	if typesErr != nil {
+		res = append(res, protocol.ErrorResponse(typesErr))
+		return
+	}
+
+	ps := nodes.PrepareStmt{
+		Query:    stmt,
+		Argtypes: nodes.List{Items: argtypes},
 	}
 
 	if parseMsg.Name == "" {
@@ -222,49 +449,164 @@ func (s *session) prepare(parseMsg *pgproto3.Parse) (res []protocol.Message, err
 }
 
 func (s *session) storePreparedStatement(ps *nodes.PrepareStmt) {
-	name := ""
-	if ps.Name != nil {
-		name = *ps.Name
+	s.pendingStmts[stmtName(ps)] = ps
+}
+
+// deallocate removes a prepared statement by its name, whether it's still
+// pending within the current transaction or already committed
+func (s *session) deallocate(name string) {
+	delete(s.pendingStmts, name)
+	delete(s.stmts, name)
+}
+
+// deallocateAll removes all of the session's prepared statements
+func (s *session) deallocateAll() {
+	s.pendingStmts = map[string]*nodes.PrepareStmt{}
+	s.stmts = map[string]*nodes.PrepareStmt{}
+}
+
+// preparedStatement looks up a prepared statement by its name. statements
+// that are still pending within the current transaction take precedence over
+// the ones that were already committed.
+func (s *session) preparedStatement(name string) (ps *nodes.PrepareStmt, ok bool) {
+	if ps, ok = s.pendingStmts[name]; !ok {
+		ps, ok = s.stmts[name]
 	}
-	s.pendingStmts[name] = ps
+	return
 }
 
-func (s *session) describe(describeMsg *pgproto3.Describe) (res []protocol.Message, err error) {
+func (s *session) describe(t *protocol.Transport, describeMsg *pgproto3.Describe) (res []protocol.Message, err error) {
+	q := s.newQuery(nil, "")
+	defer s.release(q)
+
+	var msg protocol.Message
+	var describeErr error
 	switch describeMsg.ObjectType {
 	case protocol.DescribeStatement:
-		if ps, ok := s.stmts[describeMsg.Name]; !ok {
+		ps, ok := s.preparedStatement(describeMsg.Name)
+		if !ok {
 			res = append(res, protocol.ErrorResponse(InvalidSQLStatementName(describeMsg.Name)))
-		} else {
-			var msg protocol.Message
-			msg, err = protocol.ParameterDescription(ps)
-			if err != nil {
-				return
-			}
-			res = append(res, msg)
-			// TODO: add a RowDescription message. this will require access to the backend
+			return
+		}
+		if aborted(t.TransactionStatus(), unwrapStmt(ps.Query)) {
+			res = append(res, protocol.ErrorResponse(InFailedSQLTransaction()))
+			return
 		}
+
+		msg, err = protocol.ParameterDescription(ps)
+		if err != nil {
+			return
+		}
+		res = append(res, msg)
+		msg, describeErr = q.Describe(s, ps.Query, nil)
 	case protocol.DescribePortal:
-		err = Unsupported("object type '%c'", describeMsg.ObjectType)
+		p, ok := s.portals[describeMsg.Name]
+		if !ok {
+			res = append(res, protocol.ErrorResponse(InvalidCursorName(describeMsg.Name)))
+			return
+		}
+		if aborted(t.TransactionStatus(), unwrapStmt(p.query)) {
+			res = append(res, protocol.ErrorResponse(InFailedSQLTransaction()))
+			return
+		}
+
+		msg, describeErr = q.DescribePortal(s, p)
 	default:
 		err = ProtocolViolation(fmt.Sprintf("invalid DESCRIBE message subtype '%c'", describeMsg.ObjectType))
+		return
 	}
+
+	if describeErr != nil {
+		msg = protocol.ErrorResponse(describeErr)
+	}
+	res = append(res, msg)
 	return
 }
 
-func (s *session) bind(bindMsg *pgproto3.Bind) (res []protocol.Message, err error) {
-	_, exist := s.stmts[bindMsg.PreparedStatement]
+func (s *session) bind(t *protocol.Transport, bindMsg *pgproto3.Bind) (res []protocol.Message, err error) {
+	ps, exist := s.preparedStatement(bindMsg.PreparedStatement)
 	if !exist {
 		res = append(res, protocol.ErrorResponse(InvalidSQLStatementName(bindMsg.PreparedStatement)))
 		return
 	}
+
+	if aborted(t.TransactionStatus(), unwrapStmt(ps.Query)) {
+		res = append(res, protocol.ErrorResponse(InFailedSQLTransaction()))
+		return
+	}
+
+	for _, format := range bindMsg.ResultFormatCodes {
+		if format != textFormat && format != binaryFormat {
+			res = append(res, protocol.ErrorResponse(ProtocolViolation(fmt.Sprintf("unsupported format code: %d", format))))
+			return
+		}
+	}
+
+	values, bindErr := s.decodeParams(ps, bindMsg.ParameterFormatCodes, bindMsg.Parameters)
+	if bindErr != nil {
+		res = append(res, protocol.ErrorResponse(bindErr))
+		return
+	}
+
+	query, bindErr := s.bindParams(ps, values)
+	if bindErr != nil {
+		res = append(res, protocol.ErrorResponse(bindErr))
+		return
+	}
+
+	s.closePortal(bindMsg.DestinationPortal)
 	s.portals[bindMsg.DestinationPortal] = &portal{
+		name:                 bindMsg.DestinationPortal,
 		srcPreparedStatement: bindMsg.PreparedStatement,
+		stmt:                 ps,
+		query:                query,
+		args:                 namedValues(values),
 		parameters:           bindMsg.Parameters,
+		formats:              bindMsg.ResultFormatCodes,
 	}
 	res = append(res, protocol.BindComplete)
 	return
 }
 
+// execute runs the statement bound to the requested portal. the results are
+// streamed by the query directly to the transport, so only lookup failures
+// are returned as response messages.
+func (s *session) execute(t *protocol.Transport, executeMsg *pgproto3.Execute) (res []protocol.Message, err error) {
+	p, exist := s.portals[executeMsg.Portal]
+	if !exist {
+		res = append(res, protocol.ErrorResponse(InvalidCursorName(executeMsg.Portal)))
+		return
+	}
+
+	var q *query
+	if p.rows != nil {
+		q = s.resumeQuery(t, p)
+	} else {
+		q = s.newQuery(t, "")
+	}
+	defer s.release(q)
+
+	err = q.Execute(s, p, int(executeMsg.MaxRows))
+	return
+}
+
+// close closes a prepared statement or a portal. Portals created from a closed
+// statement remain open. Closing an object that doesn't exist isn't an error.
+func (s *session) close(closeMsg *pgproto3.Close) (res []protocol.Message, err error) {
+	switch closeMsg.ObjectType {
+	case protocol.CloseStatement:
+		s.deallocate(closeMsg.Name)
+	case protocol.ClosePortal:
+		s.closePortal(closeMsg.Name)
+	default:
+		err = ProtocolViolation(fmt.Sprintf("invalid CLOSE message subtype '%c'", closeMsg.ObjectType))
+		return
+	}
+
+	res = append(res, protocol.CloseComplete)
+	return
+}
+
 func (s *session) Set(k string, v interface{}) { s.Args[k] = v }
 func (s *session) Get(k string) interface{}    { return s.Args[k] }
 func (s *session) Del(k string)                { delete(s.Args, k) }
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"github.com/jackc/pgx/pgproto3"
 	"github.com/jackc/pgx/pgtype"
+	parser "github.com/lfittl/pg_query_go"
 	"github.com/lfittl/pg_query_go/nodes"
 	nodes "github.com/lfittl/pg_query_go/nodes"
 	"github.com/panoplyio/pg-stories"
@@ -42,9 +43,54 @@ type mockQueryer struct{}
 
 func (r *mockQueryer) Query(ctx context.Context, n pg_query.Node) (driver.Rows, error) {
 	rows := &mockRows{1, 0}
+
+	// return a row for each of the VALUES lists in queries like:
+	// SELECT * FROM (VALUES(1), (2)) t
+	stmt, _ := n.(nodes.SelectStmt)
+	for _, from := range stmt.FromClause.Items {
+		sub, ok := from.(nodes.RangeSubselect)
+		if !ok {
+			continue
+		}
+		values, ok := sub.Subquery.(nodes.SelectStmt)
+		if ok && len(values.ValuesLists) > 0 {
+			rows.rows = uint8(len(values.ValuesLists))
+		}
+	}
 	return rows, nil
 }
 
+// Describe describes queries the same way Query returns them
+func (r *mockQueryer) Describe(ctx context.Context, n pg_query.Node) (driver.Rows, error) {
+	return r.Query(ctx, n)
+}
+
+// mockUndescribedQueryer is a mockQueryer that doesn't implement Describer
+type mockUndescribedQueryer struct {
+	queryer mockQueryer
+}
+
+func (r *mockUndescribedQueryer) Query(ctx context.Context, n pg_query.Node) (driver.Rows, error) {
+	return r.queryer.Query(ctx, n)
+}
+
+// mockArgsQueryer records the statements and arguments it receives
+type mockArgsQueryer struct {
+	mockQueryer
+	node pg_query.Node
+	args []driver.NamedValue
+}
+
+func (r *mockArgsQueryer) QueryArgs(ctx context.Context, n pg_query.Node, args []driver.NamedValue) (driver.Rows, error) {
+	r.node, r.args = n, args
+	return r.Query(ctx, n)
+}
+
+func (r *mockArgsQueryer) ExecArgs(ctx context.Context, n pg_query.Node, args []driver.NamedValue) (driver.Result, error) {
+	r.node, r.args = n, args
+	return driver.RowsAffected(1), nil
+}
+
 type mockRows struct {
 	rows uint8
 	pos  uint8
@@ -206,7 +252,7 @@ func TestSession_prepare(t *testing.T) {
 	t.Run("parses and stores statements", func(t *testing.T) {
 		query := "SELECT 1"
 		sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}}
-		msgs, err := sess.prepare(&pgproto3.Parse{
+		msgs, err := sess.prepare(protocol.NewTransport(nil), &pgproto3.Parse{
 			Name:  testStmtName,
 			Query: query,
 		})
@@ -220,7 +266,7 @@ func TestSession_prepare(t *testing.T) {
 		sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}}
 		sess.ConnInfo = pgtype.NewConnInfo()
 		sess.ConnInfo.RegisterDataType(pgtype.DataType{Name: "test", OID: pgtype.OID(333), Value: &pgtype.GenericText{}})
-		msgs, err := sess.prepare(&pgproto3.Parse{
+		msgs, err := sess.prepare(protocol.NewTransport(nil), &pgproto3.Parse{
 			Name:          testStmtName,
 			Query:         query,
 			ParameterOIDs: []uint32{333},
@@ -236,7 +282,7 @@ func TestSession_prepare(t *testing.T) {
 		testStmtName := "test"
 		query := "invalid"
 		sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}}
-		msgs, err := sess.prepare(&pgproto3.Parse{
+		msgs, err := sess.prepare(protocol.NewTransport(nil), &pgproto3.Parse{
 			Name:  testStmtName,
 			Query: query,
 		})
@@ -249,6 +295,31 @@ func TestSession_prepare(t *testing.T) {
 		require.Equal(t, "syntax error at or near \"invalid\"", errorRes.Message[0:33])
 		require.Nil(t, sess.pendingStmts[testStmtName])
 	})
+	t.Run("fails to parse multiple statements", func(t *testing.T) {
+		sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}}
+		msgs, err := sess.prepare(protocol.NewTransport(nil), &pgproto3.Parse{
+			Name:  testStmtName,
+			Query: "SELECT 1; SELECT 2",
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		errorRes, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "42601", errorRes.Code)
+		require.Equal(t, "cannot insert multiple commands into a prepared statement", errorRes.Message)
+		require.Nil(t, sess.pendingStmts[testStmtName])
+	})
+	t.Run("parses empty statements", func(t *testing.T) {
+		sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}}
+		msgs, err := sess.prepare(protocol.NewTransport(nil), &pgproto3.Parse{
+			Name:  testStmtName,
+			Query: " ;",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []protocol.Message{protocol.ParseComplete}, msgs)
+		require.NotNil(t, sess.pendingStmts[testStmtName])
+		require.Nil(t, sess.pendingStmts[testStmtName].Query)
+	})
 }
 
 func TestSession_bind(t *testing.T) {
@@ -261,7 +332,7 @@ func TestSession_bind(t *testing.T) {
 		})
 		// temporary hack for the test. transaction logic will be implemented on the next PR
 		sess.stmts = sess.pendingStmts
-		msgs, err := sess.bind(&pgproto3.Bind{
+		msgs, err := sess.bind(protocol.NewTransport(nil), &pgproto3.Bind{
 			PreparedStatement: testStmtName,
 		})
 		require.NoError(t, err)
@@ -278,7 +349,7 @@ func TestSession_bind(t *testing.T) {
 			Query: nodes.String{Str: query},
 		})
 		sess.stmts = sess.pendingStmts
-		msgs, err := sess.bind(&pgproto3.Bind{
+		msgs, err := sess.bind(protocol.NewTransport(nil), &pgproto3.Bind{
 			PreparedStatement: "other",
 		})
 		require.NoError(t, err)
@@ -294,7 +365,11 @@ func TestSession_bind(t *testing.T) {
 
 func TestSession_describe(t *testing.T) {
 	query := "SELECT 1"
-	sess := &session{pendingStmts: map[string]*nodes.PrepareStmt{}, portals: map[string]*portal{}}
+	sess := &session{
+		Server:       &server{queryer: &mockQueryer{}},
+		pendingStmts: map[string]*nodes.PrepareStmt{},
+		portals:      map[string]*portal{},
+	}
 	sess.storePreparedStatement(&nodes.PrepareStmt{
 		Name:  &testStmtName,
 		Query: nodes.String{Str: query},
@@ -314,17 +389,288 @@ func TestSession_describe(t *testing.T) {
 	t.Run("parameter description of prepared statement", func(t *testing.T) {
 		// temporary hack for the test. transaction logic will be implemented on the next PR
 		sess.stmts = sess.pendingStmts
-		msgs, err := sess.describe(&pgproto3.Describe{
+		msgs, err := sess.describe(protocol.NewTransport(nil), &pgproto3.Describe{
 			ObjectType: protocol.DescribeStatement,
 			Name:       testStmtName,
 		})
 		require.NoError(t, err)
-		require.Len(t, msgs, 1)
+		require.Len(t, msgs, 2)
 		msg := pgproto3.ParameterDescription{}
 		err = msg.Decode(msgs[0][5:])
 		require.NoError(t, err)
 		require.Len(t, msg.ParameterOIDs, 1)
 		require.Equal(t, uint32(16), msg.ParameterOIDs[0])
+		require.Equal(t, protocol.Message(protocol.NoData), msgs[1])
+	})
+
+	tree, err := parser.Parse(query)
+	require.NoError(t, err)
+	sess.storePreparedStatement(&nodes.PrepareStmt{Name: &anotherTestStmtName, Query: tree.Statements[0]})
+
+	t.Run("row description of prepared statement", func(t *testing.T) {
+		msgs, err := sess.describe(protocol.NewTransport(nil), &pgproto3.Describe{
+			ObjectType: protocol.DescribeStatement,
+			Name:       anotherTestStmtName,
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 2)
+		require.Equal(t, byte('T'), msgs[1].Type())
+		msg := pgproto3.RowDescription{}
+		err = msg.Decode(msgs[1][5:])
+		require.NoError(t, err)
+		require.Len(t, msg.Fields, 1)
+		require.Equal(t, "column1", msg.Fields[0].Name)
+	})
+	t.Run("fails to describe statement without Describer", func(t *testing.T) {
+		sess.Server.queryer = &mockUndescribedQueryer{}
+		defer func() { sess.Server.queryer = &mockQueryer{} }()
+
+		msgs, err := sess.describe(protocol.NewTransport(nil), &pgproto3.Describe{
+			ObjectType: protocol.DescribeStatement,
+			Name:       anotherTestStmtName,
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 2)
+		require.True(t, msgs[1].IsError())
+		errorRes, err := msgs[1].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "0A000", errorRes.Code)
+	})
+	t.Run("fails in failed transaction block", func(t *testing.T) {
+		transport := protocol.NewTransport(nil)
+		transport.SetTransactionStatus(protocol.TransactionInFailedBlock)
+		msgs, err := sess.describe(transport, &pgproto3.Describe{
+			ObjectType: protocol.DescribeStatement,
+			Name:       anotherTestStmtName,
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		errorRes, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "25P02", errorRes.Code)
+	})
+	t.Run("row description of portal without Describer", func(t *testing.T) {
+		sess.Server.queryer = &mockUndescribedQueryer{}
+		defer func() { sess.Server.queryer = &mockQueryer{} }()
+
+		p := &portal{query: tree.Statements[0]}
+		sess.portals["portal"] = p
+		msgs, err := sess.describe(protocol.NewTransport(nil), &pgproto3.Describe{
+			ObjectType: protocol.DescribePortal,
+			Name:       "portal",
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.Equal(t, byte('T'), msgs[0].Type())
+		require.NotNil(t, p.rows, "expected rows to remain open for execution")
+	})
+	t.Run("row description of portal in binary format", func(t *testing.T) {
+		sess.portals["portal"] = &portal{query: tree.Statements[0], formats: []int16{1}}
+		msgs, err := sess.describe(protocol.NewTransport(nil), &pgproto3.Describe{
+			ObjectType: protocol.DescribePortal,
+			Name:       "portal",
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		msg := pgproto3.RowDescription{}
+		err = msg.Decode(msgs[0][5:])
+		require.NoError(t, err)
+		require.Equal(t, int16(1), msg.Fields[0].Format)
+	})
+	t.Run("no data of portal", func(t *testing.T) {
+		sess.portals["portal"] = &portal{query: nodes.String{Str: query}}
+		msgs, err := sess.describe(protocol.NewTransport(nil), &pgproto3.Describe{
+			ObjectType: protocol.DescribePortal,
+			Name:       "portal",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []protocol.Message{protocol.NoData}, msgs)
+	})
+	t.Run("fails if portal not found", func(t *testing.T) {
+		msgs, err := sess.describe(protocol.NewTransport(nil), &pgproto3.Describe{
+			ObjectType: protocol.DescribePortal,
+			Name:       "other",
+		})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		errorRes, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "34000", errorRes.Code)
+	})
+}
+
+func TestSession_close(t *testing.T) {
+	sess := &session{
+		stmts:        map[string]*nodes.PrepareStmt{},
+		pendingStmts: map[string]*nodes.PrepareStmt{},
+		portals:      map[string]*portal{},
+	}
+
+	t.Run("closes a prepared statement", func(t *testing.T) {
+		sess.stmts[testStmtName] = &nodes.PrepareStmt{Name: &testStmtName}
+		sess.pendingStmts[testStmtName] = &nodes.PrepareStmt{Name: &testStmtName}
+		msgs, err := sess.close(&pgproto3.Close{
+			ObjectType: protocol.CloseStatement,
+			Name:       testStmtName,
+		})
+		require.NoError(t, err)
+		require.Equal(t, []protocol.Message{protocol.CloseComplete}, msgs)
+		require.Empty(t, sess.stmts)
+		require.Empty(t, sess.pendingStmts)
+	})
+	t.Run("closes a portal", func(t *testing.T) {
+		rows := &mockRows{rows: 1}
+		sess.portals["portal"] = &portal{rows: rows}
+		msgs, err := sess.close(&pgproto3.Close{
+			ObjectType: protocol.ClosePortal,
+			Name:       "portal",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []protocol.Message{protocol.CloseComplete}, msgs)
+		require.Empty(t, sess.portals)
+	})
+	t.Run("ignores missing objects", func(t *testing.T) {
+		msgs, err := sess.close(&pgproto3.Close{
+			ObjectType: protocol.ClosePortal,
+			Name:       "other",
+		})
+		require.NoError(t, err)
+		require.Equal(t, []protocol.Message{protocol.CloseComplete}, msgs)
+	})
+	t.Run("fails on invalid object type", func(t *testing.T) {
+		_, err := sess.close(&pgproto3.Close{ObjectType: 'X'})
+		require.Error(t, err)
+		require.Equal(t, "08P01", fromErr(err).Code())
+	})
+}
+
+func TestSession_execute(t *testing.T) {
+	query := "SELECT 1"
+	tree, err := parser.Parse(query)
+	require.NoError(t, err)
+
+	t.Run("executes a portal", func(t *testing.T) {
+		f, b := net.Pipe()
+		frontend, err := pgproto3.NewFrontend(f, nil)
+		require.NoError(t, err)
+
+		sess := &session{
+			Server: &server{queryer: &mockQueryer{}},
+			portals: map[string]*portal{
+				"": {query: tree.Statements[0]},
+			},
+		}
+		go func() {
+			msgs, err := sess.execute(protocol.NewTransport(b), &pgproto3.Execute{})
+			require.NoError(t, err)
+			require.Empty(t, msgs)
+		}()
+
+		// no RowDescription is expected within Execute
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.DataRow{}, msg)
+		require.Equal(t, "row 0", string(msg.(*pgproto3.DataRow).Values[0]))
+
+		msg, err = frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.CommandComplete{}, msg)
+		require.Equal(t, "SELECT 1", msg.(*pgproto3.CommandComplete).CommandTag)
+	})
+	t.Run("suspends and resumes a portal", func(t *testing.T) {
+		f, b := net.Pipe()
+		frontend, err := pgproto3.NewFrontend(f, nil)
+		require.NoError(t, err)
+
+		rows := &mockRows{rows: 2}
+		p := &portal{query: tree.Statements[0]}
+		sess := &session{
+			Server:  &server{queryer: &mockQueryer{}},
+			portals: map[string]*portal{"": p},
+		}
+		p.rows, p.ctx = rows, context.Background()
+
+		executed := make(chan struct{})
+		go func() {
+			defer close(executed)
+			for i := 0; i < 3; i++ {
+				msgs, err := sess.execute(protocol.NewTransport(b), &pgproto3.Execute{MaxRows: 1})
+				require.NoError(t, err)
+				require.Empty(t, msgs)
+			}
+		}()
+
+		for i := 0; i < 2; i++ {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.DataRow{}, msg)
+			require.Equal(t, fmt.Sprintf("row %d", i), string(msg.(*pgproto3.DataRow).Values[0]))
+
+			msg, err = frontend.Receive()
+			require.NoError(t, err)
+			require.IsType(t, &pgproto3.PortalSuspended{}, msg)
+		}
+
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.CommandComplete{}, msg)
+		require.Equal(t, "SELECT 0", msg.(*pgproto3.CommandComplete).CommandTag)
+
+		<-executed
+		require.Equal(t, uint8(2), rows.pos, "expected rows to be consumed once")
+		require.Nil(t, p.rows)
+		require.True(t, p.done)
+	})
+	t.Run("provides arguments separately", func(t *testing.T) {
+		for _, query := range []string{"SELECT $1", "DELETE FROM t WHERE a = $1"} {
+			f, b := net.Pipe()
+			frontend, err := pgproto3.NewFrontend(f, nil)
+			require.NoError(t, err)
+
+			queryer := &mockArgsQueryer{}
+			sess := &session{
+				Server:       &server{queryer: queryer},
+				ConnInfo:     newConnInfo(),
+				stmts:        map[string]*nodes.PrepareStmt{},
+				pendingStmts: map[string]*nodes.PrepareStmt{},
+				portals:      map[string]*portal{},
+			}
+			sess.storePreparedStatement(preparedStatement(t, query, typeName(23, "int4")))
+			msgs, err := sess.bind(protocol.NewTransport(nil), &pgproto3.Bind{
+				PreparedStatement: testStmtName,
+				Parameters:        [][]byte{[]byte("42")},
+			})
+			require.NoError(t, err)
+			require.False(t, msgs[0].IsError())
+
+			go func() {
+				msgs, err := sess.execute(protocol.NewTransport(b), &pgproto3.Execute{})
+				require.NoError(t, err)
+				require.Empty(t, msgs)
+			}()
+
+			for {
+				msg, err := frontend.Receive()
+				require.NoError(t, err)
+				if _, ok := msg.(*pgproto3.CommandComplete); ok {
+					break
+				}
+			}
+
+			require.Equal(t, []driver.NamedValue{{Ordinal: 1, Value: int64(42)}}, queryer.args)
+			require.Equal(t, unwrapStmt(sess.pendingStmts[testStmtName].Query), queryer.node)
+		}
+	})
+	t.Run("fails if portal not found", func(t *testing.T) {
+		sess := &session{portals: map[string]*portal{}}
+		msgs, err := sess.execute(nil, &pgproto3.Execute{Portal: "other"})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		require.True(t, msgs[0].IsError())
+		errorRes, err := msgs[0].ErrorResponse()
+		require.NoError(t, err)
+		require.Equal(t, "34000", errorRes.Code)
+		require.Equal(t, "portal \"other\" does not exist", errorRes.Message)
 	})
 }
 
@@ -408,8 +754,6 @@ func filterStartupMessages(msg pgproto3.BackendMessage) bool {
 const TestDataFolder = "testdata"
 
 func TestSession_Serve(t *testing.T) {
-	t.Skip("extended query flow is still under development so we skip the tests")
-
 	currentDirPath, err := os.Getwd()
 	if err != nil {
 		require.NoError(t, err)
@@ -419,8 +763,9 @@ func TestSession_Serve(t *testing.T) {
 
 	runner := &pgStoryScriptsRunner{
 		baseFolder: dataTestPath,
+
 		init: func() (net.Conn, chan interface{}) {
-			f, b := net.Pipe()
+			f, b := loopbackPipe(t)
 			srv := server{
 				authenticator: &noPasswordAuthenticator{},
 				queryer:       &mockQueryer{},
@@ -430,7 +775,7 @@ func TestSession_Serve(t *testing.T) {
 
 			sess := &session{Conn: b, Server: &srv}
 			go func() {
-				err = sess.Serve()
+				err := sess.Serve()
 				if err != nil {
 					killStory <- err
 					require.NoError(t, err)
@@ -442,6 +787,22 @@ func TestSession_Serve(t *testing.T) {
 	runner.run(t)
 }
 
+// loopbackPipe is like net.Pipe, except that the connections are buffered by
+// the OS, allowing the frontend to pipeline messages without waiting for the
+// backend to read them.
+func loopbackPipe(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	f, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	b, err := ln.Accept()
+	require.NoError(t, err)
+	return f, b
+}
+
 func TestRealServer(t *testing.T) {
 	t.Skip("used for local development as baseline testing against postgres server")
 
@@ -496,8 +857,9 @@ func TestSession_startUp(t *testing.T) {
 	t.Run("protocol version 3.0", func(t *testing.T) {
 		s := session{Server: &srv, Conn: &mockConn{b: buf}}
 		buf.Write([]byte{
-			0, 0, 0, 8, // length
+			0, 0, 0, 22, // length
 			0, 3, 0, 0, // 3.0
+			'u', 's', 'e', 'r', 0, 'p', 'o', 's', 't', 'g', 'r', 'e', 's', 0,
 		})
 		err := s.startUp()
 		require.NoError(t, err)
@@ -520,6 +882,25 @@ func TestSession_startUp(t *testing.T) {
 		require.IsType(t, &pgproto3.BackendKeyData{}, msg)
 	})
 
+	t.Run("missing user", func(t *testing.T) {
+		s := session{Server: &srv, Conn: &mockConn{b: buf}}
+		buf.Write([]byte{
+			0, 0, 0, 8, // length
+			0, 3, 0, 0, // 3.0
+		})
+		err := s.startUp()
+		require.EqualError(t, err, "no PostgreSQL user name specified in startup packet")
+
+		reader, err := pgproto3.NewFrontend(buf, nil)
+		require.NoError(t, err)
+
+		msg, err := reader.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		require.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+	})
+
 	t.Run("cancel", func(t *testing.T) {
 		canceled := false
 		s := session{Server: &srv, Secret: 123, Conn: &mockConn{b: buf}, CancelFunc: func() {
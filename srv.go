@@ -2,37 +2,132 @@ package pgsrv
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql/driver"
 	nodes "github.com/lfittl/pg_query_go/nodes"
 	"net"
+	"time"
 )
 
 // implements the Server interface
 type server struct {
 	queryer       Queryer
-	authenticator authenticator
+	authenticator Authenticator
+	types         *Types
+
+	// TLS configuration of the connections, nil when TLS isn't supported
+	tlsConfig   *tls.Config
+	tlsRequired bool // reject startups that weren't upgraded to TLS
+	clientCAs   *x509.CertPool
+
+	authLimits *AuthLimits // brute-force protection of the authenticator, if any
+
+	// default timeouts of the sessions, zero means no timeout
+	statementTimeout                time.Duration
+	idleInTransactionSessionTimeout time.Duration
+}
+
+// Option configures a server created by New
+type Option func(*server)
+
+// WithTypes sets the registry of the data types supported by the server,
+// which can be extended by user defined types. By default, only the built-in
+// types are supported.
+func WithTypes(types *Types) Option {
+	return func(s *server) { s.types = types }
+}
+
+// WithAuthenticator sets the Authenticator of the clients, which replaces the
+// one New picks by the queryer.
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *server) { s.authenticator = a }
+}
+
+// WithAuthLimits protects the server's authenticator against brute-force
+// attacks on passwords, by the provided limits (see AuthLimits).
+func WithAuthLimits(limits AuthLimits) Option {
+	return func(s *server) { s.authLimits = &limits }
+}
+
+// WithTLS lets clients upgrade their connections to TLS with the provided
+// configuration, which must include the server's certificate. Without it, SSL
+// requests are declined.
+func WithTLS(config *tls.Config) Option {
+	return func(s *server) { s.tlsConfig = config }
+}
+
+// WithTLSRequired makes TLS mandatory, such that startups over plaintext
+// connections are rejected with a FATAL error. It requires WithTLS.
+func WithTLSRequired() Option {
+	return func(s *server) { s.tlsRequired = true }
+}
+
+// WithClientCAs verifies the certificates that clients present against the
+// provided pool of certificate authorities, which lets them authenticate by
+// their certificates (see the cert method of NewHBAAuthenticator). Clients
+// aren't required to present certificates, unless they authenticate by them.
+// It requires WithTLS.
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(s *server) { s.clientCAs = pool }
+}
+
+// WithStatementTimeout sets the default statement_timeout of the sessions,
+// which abort queries that take longer. Sessions can override it by their
+// startup parameters or SET.
+func WithStatementTimeout(timeout time.Duration) Option {
+	return func(s *server) { s.statementTimeout = timeout }
+}
+
+// WithIdleInTransactionSessionTimeout sets the default
+// idle_in_transaction_session_timeout of the sessions, which terminate once
+// they're idle within a transaction block for longer. Sessions can override it
+// by their startup parameters or SET.
+func WithIdleInTransactionSessionTimeout(timeout time.Duration) Option {
+	return func(s *server) { s.idleInTransactionSessionTimeout = timeout }
 }
 
 // New creates a Server object capable of handling postgres client connections.
 // It delegates query execution to the provided Queryer. If the provided Queryer
 // also implements Execer, the returned server will also be able to handle
-// executing SQL commands (see Execer).
+// executing SQL commands (see Execer). Similarly, implementing QueryerWithArgs
+// or ExecerWithArgs lets it receive the arguments of prepared statements
+// separately from the statement, and implementing Transactor lets it handle
+// transaction blocks.
+//
+// If queryer implements PasswordProvider interface, a new server will be protected
+// with an authenticator of its auth type (see NewPasswordAuthenticator). If it
+// implements CredentialsProvider, each user is authenticated by the method of
+// its own credentials instead (see NewCredentialsAuthenticator). Either is
+// replaced by the Authenticator provided by WithAuthenticator, and may be
+// protected against brute-force attacks by WithAuthLimits.
 //
-// If queryer implements passwordProvider interface, a new server will be protected
-// with a new md5Authenticator.
-func New(queryer Queryer) Server {
-	var auth authenticator
+// The server is further configured by the provided options.
+func New(queryer Queryer, opts ...Option) Server {
+	var auth Authenticator
 	auth = &noPasswordAuthenticator{}
-	pp, ok := queryer.(PasswordProvider)
-	if ok {
-		switch pp.Type() {
-		case MD5:
-			auth = &md5Authenticator{pp}
-		case Plain:
-			auth = &clearTextAuthenticator{pp}
+	if pp, ok := queryer.(PasswordProvider); ok {
+		auth = NewPasswordAuthenticator(pp)
+	}
+	if cp, ok := queryer.(CredentialsProvider); ok {
+		auth = NewCredentialsAuthenticator(cp)
+	}
+	s := &server{queryer: queryer, authenticator: auth, types: NewTypes()}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.authLimits != nil {
+		s.authenticator = newLimitedAuthenticator(s.authenticator, *s.authLimits)
+	}
+	if s.tlsConfig != nil && s.clientCAs != nil {
+		s.tlsConfig = s.tlsConfig.Clone()
+		s.tlsConfig.ClientCAs = s.clientCAs
+		if s.tlsConfig.ClientAuth == tls.NoClientCert {
+			s.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 		}
 	}
-	return &server{queryer, auth}
+	return s
 }
 
 // implements Queryer
@@ -44,6 +139,10 @@ func (s *server) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
 func (s *server) Exec(ctx context.Context, n nodes.Node) (driver.Result, error) {
 	execer, ok := s.queryer.(Execer)
 	if !ok {
+		if _, ok := n.(nodes.TransactionStmt); ok {
+			// read-only backends have nothing to commit or roll back
+			return driver.ResultNoRows, nil
+		}
 		return nil, Unsupported("commands execution. Read-only mode.")
 	}
 
@@ -0,0 +1,222 @@
+package pgsrv
+
+import (
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeout settings enforced by the sessions, which can be set by the startup
+// parameters or SET
+const (
+	statementTimeout                = "statement_timeout"
+	idleInTransactionSessionTimeout = "idle_in_transaction_session_timeout"
+)
+
+// timeoutUnits maps the units of timeout settings to their durations. Values
+// without a unit are in milliseconds, just like in Postgres.
+var timeoutUnits = map[string]time.Duration{
+	"":    time.Millisecond,
+	"us":  time.Microsecond,
+	"ms":  time.Millisecond,
+	"s":   time.Second,
+	"min": time.Minute,
+	"h":   time.Hour,
+	"d":   24 * time.Hour,
+}
+
+// parseTimeout parses the value of a timeout setting, like 1500 or '2s'
+func parseTimeout(name, value string) (time.Duration, error) {
+	s := strings.TrimSpace(value)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	unit, ok := timeoutUnits[strings.TrimSpace(s[i:])]
+	if err != nil || !ok {
+		return 0, InvalidParameterValue(name, value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// isTimeout determines if the setting is one of the timeouts enforced by the
+// sessions
+func isTimeout(name string) bool {
+	return name == statementTimeout || name == idleInTransactionSessionTimeout
+}
+
+// timeout returns the value of the session's timeout setting. Values SET LOCAL
+// in the transaction block take precedence over the values SET during the
+// session, which take precedence over the defaults.
+func (s *session) timeout(name string) time.Duration {
+	if d, ok := s.localTimeouts[name]; ok {
+		return d
+	}
+	if d, ok := s.timeouts[name]; ok {
+		return d
+	}
+	return s.defaultTimeout(name)
+}
+
+// defaultTimeout returns the default value of the session's timeout setting:
+// the startup parameter, or the server's default when there's none.
+func (s *session) defaultTimeout(name string) time.Duration {
+	if v, ok := s.Args[name].(string); ok {
+		// startup parameters were already validated by startUp
+		d, _ := parseTimeout(name, v)
+		return d
+	}
+
+	if s.Server == nil {
+		return 0
+	}
+
+	switch name {
+	case statementTimeout:
+		return s.Server.statementTimeout
+	case idleInTransactionSessionTimeout:
+		return s.Server.idleInTransactionSessionTimeout
+	default:
+		return 0
+	}
+}
+
+// validateTimeouts verifies that the timeout settings of the startup
+// parameters are valid
+func (s *session) validateTimeouts() error {
+	for _, name := range []string{statementTimeout, idleInTransactionSessionTimeout} {
+		if v, ok := s.Args[name].(string); ok {
+			if _, err := parseTimeout(name, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setTimeout handles SET and RESET of the timeout settings. It reports if the
+// statement was handled, as the rest of the settings are left for the backend.
+// Values SET LOCAL last until the transaction block ends (see endLocalTimeouts).
+func (s *session) setTimeout(stmt nodes.VariableSetStmt) (bool, error) {
+	if stmt.Kind == nodes.VAR_RESET_ALL {
+		// the backend resets the rest of its settings as well
+		s.timeouts, s.localTimeouts = nil, nil
+		return false, nil
+	}
+
+	if stmt.Name == nil || !isTimeout(*stmt.Name) {
+		return false, nil
+	}
+
+	name := *stmt.Name
+	var d time.Duration
+	switch stmt.Kind {
+	case nodes.VAR_SET_VALUE:
+		var err error
+		d, err = parseTimeout(name, settingValue(stmt.Args))
+		if err != nil {
+			return true, err
+		}
+	case nodes.VAR_SET_DEFAULT, nodes.VAR_RESET:
+		d = s.defaultTimeout(name)
+	default:
+		return false, nil
+	}
+
+	if stmt.IsLocal {
+		if s.localTimeouts == nil {
+			s.localTimeouts = map[string]time.Duration{}
+		}
+		s.localTimeouts[name] = d
+		return true, nil
+	}
+
+	// SET overrides SET LOCAL for the rest of the transaction block as well
+	delete(s.localTimeouts, name)
+	if stmt.Kind == nodes.VAR_SET_VALUE {
+		if s.timeouts == nil {
+			s.timeouts = map[string]time.Duration{}
+		}
+		s.timeouts[name] = d
+	} else {
+		delete(s.timeouts, name)
+	}
+	return true, nil
+}
+
+// saveTimeouts saves the timeout settings before the first SET of the
+// transaction block, to be restored if the block is rolled back
+func (s *session) saveTimeouts() {
+	if s.savedTimeouts != nil {
+		return
+	}
+
+	s.savedTimeouts = make(map[string]time.Duration, len(s.timeouts))
+	for name, d := range s.timeouts {
+		s.savedTimeouts[name] = d
+	}
+}
+
+// endLocalTimeouts restores the timeout settings SET LOCAL as the transaction
+// block ends. When the block is rolled back, the settings SET within it are
+// restored as well.
+func (s *session) endLocalTimeouts(rollback bool) {
+	if rollback && s.savedTimeouts != nil {
+		s.timeouts = s.savedTimeouts
+	}
+	s.localTimeouts, s.savedTimeouts = nil, nil
+}
+
+// settingValue returns the value of SET as a string, like it's provided by the
+// startup parameters
+func settingValue(args nodes.List) string {
+	if len(args.Items) != 1 {
+		return ""
+	}
+
+	c, _ := args.Items[0].(nodes.A_Const)
+	switch v := c.Val.(type) {
+	case nodes.Integer:
+		return strconv.FormatInt(v.Ival, 10)
+	case nodes.String:
+		return v.Str
+	default:
+		return ""
+	}
+}
+
+// readDeadliner is implemented by connections that support read deadlines,
+// like net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// armIdleTimeout sets a read deadline for the next message according to the
+// idle_in_transaction_session_timeout, when within a transaction block. It
+// reports if the deadline was set.
+func (s *session) armIdleTimeout(status protocol.TransactionStatus) bool {
+	conn, ok := s.Conn.(readDeadliner)
+	if !ok {
+		return false
+	}
+
+	timeout := s.timeout(idleInTransactionSessionTimeout)
+	if status == protocol.TransactionIdle || timeout == 0 {
+		conn.SetReadDeadline(time.Time{})
+		return false
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	return true
+}
+
+// isTimeoutErr determines if the error is caused by a read deadline
+func isTimeoutErr(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,200 @@
+package pgsrv
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"github.com/jackc/pgx/pgproto3"
+	parser "github.com/lfittl/pg_query_go"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// mockSlowQueryer blocks until the query's context is done
+type mockSlowQueryer struct {
+	mockQueryer
+}
+
+func (r *mockSlowQueryer) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestParseTimeout(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"0":       0,
+		"1500":    1500 * time.Millisecond,
+		"10ms":    10 * time.Millisecond,
+		"2s":      2 * time.Second,
+		" 3 min ": 3 * time.Minute,
+		"1h":      time.Hour,
+		"1d":      24 * time.Hour,
+		"500us":   500 * time.Microsecond,
+	} {
+		d, err := parseTimeout(statementTimeout, value)
+		require.NoError(t, err)
+		require.Equal(t, expected, d, value)
+	}
+
+	for _, value := range []string{"", "abc", "-1", "5 years"} {
+		_, err := parseTimeout(statementTimeout, value)
+		require.Error(t, err, value)
+		require.Equal(t, "22023", fromErr(err).Code())
+	}
+}
+
+func TestSession_timeout(t *testing.T) {
+	sess := &session{
+		Server: &server{statementTimeout: time.Second},
+		Args:   map[string]interface{}{},
+	}
+	set := func(t *testing.T, sql string) {
+		tree, err := parser.Parse(sql)
+		require.NoError(t, err)
+		handled, err := sess.setTimeout(unwrapStmt(tree.Statements[0]).(nodes.VariableSetStmt))
+		require.NoError(t, err)
+		require.True(t, handled)
+	}
+
+	require.Equal(t, time.Second, sess.timeout(statementTimeout), "expected the server's default")
+	sess.Args[statementTimeout] = "2s"
+	require.Equal(t, 2*time.Second, sess.timeout(statementTimeout), "expected the startup parameter")
+	set(t, "SET statement_timeout = 3000")
+	require.Equal(t, 3*time.Second, sess.timeout(statementTimeout), "expected the SET value")
+	set(t, "SET statement_timeout TO '4s'")
+	require.Equal(t, 4*time.Second, sess.timeout(statementTimeout), "expected the SET value")
+	set(t, "RESET statement_timeout")
+	require.Equal(t, 2*time.Second, sess.timeout(statementTimeout), "expected the startup parameter")
+
+	t.Run("leaves other settings to the backend", func(t *testing.T) {
+		tree, err := parser.Parse("SET search_path = public")
+		require.NoError(t, err)
+		handled, err := sess.setTimeout(unwrapStmt(tree.Statements[0]).(nodes.VariableSetStmt))
+		require.NoError(t, err)
+		require.False(t, handled)
+	})
+	t.Run("fails on invalid values", func(t *testing.T) {
+		tree, err := parser.Parse("SET statement_timeout = 'forever'")
+		require.NoError(t, err)
+		_, err = sess.setTimeout(unwrapStmt(tree.Statements[0]).(nodes.VariableSetStmt))
+		require.Error(t, err)
+		require.Equal(t, "invalid value for parameter \"statement_timeout\": \"forever\"", err.Error())
+	})
+}
+
+func TestQuery_localTimeout(t *testing.T) {
+	sess := &session{Server: &server{queryer: &mockQueryer{}, statementTimeout: time.Second}}
+	transport := protocol.NewTransport(&bytes.Buffer{})
+	run := func(t *testing.T, sql string) {
+		err := sess.newQuery(transport, sql).Run(sess)
+		require.NoError(t, err)
+	}
+
+	t.Run("restored when the transaction block ends", func(t *testing.T) {
+		for _, end := range []string{"COMMIT", "ROLLBACK"} {
+			run(t, "SET statement_timeout = '2s'")
+			run(t, "BEGIN")
+			run(t, "SET LOCAL statement_timeout = '3s'")
+			require.Equal(t, 3*time.Second, sess.timeout(statementTimeout), "expected the SET LOCAL value")
+			run(t, "SET LOCAL statement_timeout TO DEFAULT")
+			require.Equal(t, time.Second, sess.timeout(statementTimeout), "expected the server's default")
+			run(t, end)
+			require.Equal(t, 2*time.Second, sess.timeout(statementTimeout), "expected the SET value after %s", end)
+		}
+	})
+	t.Run("overridden by SET", func(t *testing.T) {
+		run(t, "BEGIN")
+		run(t, "SET LOCAL statement_timeout = '3s'")
+		run(t, "SET statement_timeout = '4s'")
+		require.Equal(t, 4*time.Second, sess.timeout(statementTimeout))
+		run(t, "COMMIT")
+		require.Equal(t, 4*time.Second, sess.timeout(statementTimeout))
+	})
+	t.Run("SET reverted by rollback", func(t *testing.T) {
+		for _, end := range [][]string{{"ROLLBACK"}, {"DELETE FROM t", "COMMIT"}} {
+			run(t, "BEGIN")
+			run(t, "SET statement_timeout = '5s'")
+			run(t, "RESET statement_timeout")
+			require.Equal(t, time.Second, sess.timeout(statementTimeout))
+			for _, sql := range end {
+				run(t, sql)
+			}
+			require.Equal(t, 4*time.Second, sess.timeout(statementTimeout), "expected the SET value before the block after %v", end)
+		}
+	})
+	t.Run("no effect outside of transaction blocks", func(t *testing.T) {
+		run(t, "SET LOCAL statement_timeout = '5s'")
+		require.Equal(t, 4*time.Second, sess.timeout(statementTimeout))
+	})
+}
+
+func TestQuery_statementTimeout(t *testing.T) {
+	buf := &bytes.Buffer{}
+	frontend, err := pgproto3.NewFrontend(buf, nil)
+	require.NoError(t, err)
+
+	sess := &session{Server: &server{queryer: &mockSlowQueryer{}}}
+	transport := protocol.NewTransport(buf)
+	err = sess.newQuery(transport, "SET statement_timeout = '10ms'").Run(sess)
+	require.NoError(t, err)
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, "SET", msg.(*pgproto3.CommandComplete).CommandTag)
+
+	err = sess.newQuery(transport, "SELECT 1").Run(sess)
+	require.NoError(t, err)
+
+	msg, err = frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, "57014", msg.(*pgproto3.ErrorResponse).Code)
+	require.Equal(t, "canceling statement due to statement timeout", msg.(*pgproto3.ErrorResponse).Message)
+}
+
+func TestSession_idleInTransactionSessionTimeout(t *testing.T) {
+	f, b := loopbackPipe(t)
+	defer f.Close()
+
+	sess := &session{Conn: b, Server: &server{
+		authenticator:                   &noPasswordAuthenticator{},
+		queryer:                         &mockQueryer{},
+		idleInTransactionSessionTimeout: 50 * time.Millisecond,
+	}}
+	served := make(chan error)
+	go func() { served <- sess.Serve() }()
+
+	frontend, err := pgproto3.NewFrontend(f, f)
+	require.NoError(t, err)
+	err = frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	})
+	require.NoError(t, err)
+
+	receiveUntilReady := func() *pgproto3.ReadyForQuery {
+		for {
+			msg, err := frontend.Receive()
+			require.NoError(t, err)
+			if ready, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				return ready
+			}
+		}
+	}
+
+	// idle sessions aren't terminated
+	receiveUntilReady()
+	time.Sleep(100 * time.Millisecond)
+
+	err = frontend.Send(&pgproto3.Query{String: "BEGIN"})
+	require.NoError(t, err)
+	require.Equal(t, byte(protocol.TransactionInBlock), receiveUntilReady().TxStatus)
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, "25P03", msg.(*pgproto3.ErrorResponse).Code)
+	require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+	require.Error(t, <-served)
+}
@@ -0,0 +1,237 @@
+package pgsrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"github.com/jackc/pgx/pgproto3"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSignedTLS creates the TLS configurations of a server with a self-signed
+// certificate for localhost, and of a client that verifies it
+func selfSignedTLS(t *testing.T) (srvConfig *tls.Config, clientConfig *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	srvConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	clientConfig = &tls.Config{RootCAs: roots, ServerName: "localhost"}
+	return
+}
+
+// issueClientCert issues a client certificate by the certificate authority of
+// the server's configuration created by selfSignedTLS
+func issueClientCert(t *testing.T, srvConfig *tls.Config, cn string, dnsNames ...string) tls.Certificate {
+	ca, err := x509.ParseCertificate(srvConfig.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, srvConfig.Certificates[0].PrivateKey)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// sslRequest is the SSLRequest message, sent by frontends before startup
+func sslRequest() []byte {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg[0:4], 8)
+	binary.BigEndian.PutUint32(msg[4:8], 80877103)
+	return msg
+}
+
+func TestSession_startUp_tls(t *testing.T) {
+	srvConfig, clientConfig := selfSignedTLS(t)
+	startup := (&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "postgres"},
+	}).Encode(nil)
+
+	// startUp starts up a session of a server with the provided options
+	startUp := func(b net.Conn, opts ...Option) chan error {
+		srv := New(&mockQueryer{}, opts...).(*server)
+		errs := make(chan error, 1)
+		go func() {
+			s := &session{Server: srv, Conn: b}
+			errs <- s.startUp()
+		}()
+		return errs
+	}
+
+	t.Run("upgrades to TLS", func(t *testing.T) {
+		f, b := loopbackPipe(t)
+		defer f.Close()
+		errs := startUp(b, WithTLS(srvConfig), WithTLSRequired())
+
+		_, err := f.Write(sslRequest())
+		require.NoError(t, err)
+		res := make([]byte, 1)
+		_, err = f.Read(res)
+		require.NoError(t, err)
+		require.Equal(t, "S", string(res))
+
+		conn := tls.Client(f, clientConfig)
+		require.NoError(t, conn.Handshake())
+		_, err = conn.Write(startup)
+		require.NoError(t, err)
+
+		frontend, err := pgproto3.NewFrontend(conn, nil)
+		require.NoError(t, err)
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.Authentication{}, msg)
+		require.NoError(t, <-errs)
+	})
+	t.Run("provides the TLS state to the authenticator", func(t *testing.T) {
+		f, b := loopbackPipe(t)
+		defer f.Close()
+		a := &mockAuthenticator{}
+		errs := startUp(b, WithTLS(srvConfig), WithAuthenticator(a))
+
+		_, err := f.Write(sslRequest())
+		require.NoError(t, err)
+		_, err = f.Read(make([]byte, 1))
+		require.NoError(t, err)
+
+		conn := tls.Client(f, clientConfig)
+		require.NoError(t, conn.Handshake())
+		_, err = conn.Write(startup)
+		require.NoError(t, err)
+		require.Error(t, <-errs)
+
+		require.NotNil(t, a.client.TLS)
+		require.True(t, a.client.TLS.HandshakeComplete)
+		require.Equal(t, f.LocalAddr().String(), a.client.RemoteAddr.String())
+	})
+	t.Run("declines SSL requests without TLS", func(t *testing.T) {
+		f, b := loopbackPipe(t)
+		defer f.Close()
+		errs := startUp(b)
+
+		_, err := f.Write(sslRequest())
+		require.NoError(t, err)
+		res := make([]byte, 1)
+		_, err = f.Read(res)
+		require.NoError(t, err)
+		require.Equal(t, "N", string(res))
+
+		_, err = f.Write(startup)
+		require.NoError(t, err)
+		frontend, err := pgproto3.NewFrontend(f, nil)
+		require.NoError(t, err)
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.Authentication{}, msg)
+		require.NoError(t, <-errs)
+	})
+	t.Run("rejects plaintext startups when TLS is required", func(t *testing.T) {
+		f, b := loopbackPipe(t)
+		defer f.Close()
+		errs := startUp(b, WithTLS(srvConfig), WithTLSRequired())
+
+		_, err := f.Write(startup)
+		require.NoError(t, err)
+		frontend, err := pgproto3.NewFrontend(f, nil)
+		require.NoError(t, err)
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		require.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+		require.Equal(t, "FATAL", msg.(*pgproto3.ErrorResponse).Severity)
+		require.Error(t, <-errs)
+	})
+}
+
+func TestSession_startUp_clientCert(t *testing.T) {
+	srvConfig, clientConfig := selfSignedTLS(t)
+	pool := x509.NewCertPool()
+	ca, err := x509.ParseCertificate(srvConfig.Certificates[0].Certificate[0])
+	require.NoError(t, err)
+	pool.AddCert(ca)
+
+	hba, err := ParseHBA(strings.NewReader("hostssl all all all cert map=certmap"))
+	require.NoError(t, err)
+	ident, err := ParseIdent(strings.NewReader(`certmap /^(.*)\.internal$ \1`))
+	require.NoError(t, err)
+	a, err := NewHBAAuthenticator(hba, ident, nil)
+	require.NoError(t, err)
+
+	// connect connects as the user with the provided certificates, and returns
+	// the first response to the startup
+	connect := func(user string, certs ...tls.Certificate) pgproto3.BackendMessage {
+		f, b := loopbackPipe(t)
+		defer f.Close()
+		srv := New(&mockQueryer{}, WithTLS(srvConfig), WithClientCAs(pool), WithAuthenticator(a)).(*server)
+		go (&session{Server: srv, Conn: b}).startUp()
+
+		_, err := f.Write(sslRequest())
+		require.NoError(t, err)
+		_, err = f.Read(make([]byte, 1))
+		require.NoError(t, err)
+
+		config := clientConfig.Clone()
+		config.Certificates = certs
+		conn := tls.Client(f, config)
+		require.NoError(t, conn.Handshake())
+		_, err = conn.Write((&pgproto3.StartupMessage{
+			ProtocolVersion: pgproto3.ProtocolVersionNumber,
+			Parameters:      map[string]string{"user": user},
+		}).Encode(nil))
+		require.NoError(t, err)
+
+		frontend, err := pgproto3.NewFrontend(conn, nil)
+		require.NoError(t, err)
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		return msg
+	}
+
+	cert := issueClientCert(t, srvConfig, "Billing Service", "billing.internal")
+	require.IsType(t, &pgproto3.Authentication{}, connect("billing", cert))
+
+	msg := connect("admin", cert)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	require.Equal(t, "28000", msg.(*pgproto3.ErrorResponse).Code)
+	require.Equal(t, "certificate authentication failed for user \"admin\"", msg.(*pgproto3.ErrorResponse).Message)
+
+	msg = connect("billing")
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	require.Equal(t, "connection requires a valid client certificate", msg.(*pgproto3.ErrorResponse).Message)
+}
@@ -0,0 +1,78 @@
+package pgsrv
+
+import (
+	"context"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+)
+
+// transact handles the transaction control statement with the Transactor,
+// beginning a transaction block or using the session's open one
+func (s *session) transact(ctx context.Context, transactor Transactor, stmt nodes.TransactionStmt) (err error) {
+	switch stmt.Kind {
+	case nodes.TRANS_STMT_BEGIN, nodes.TRANS_STMT_START:
+		if s.tx != nil {
+			// already in a transaction block
+			return nil
+		}
+		// the transaction block outlives the BEGIN statement, along with its
+		// statement_timeout, so it's bound to the session's context instead
+		s.tx, err = transactor.Begin(s.sessionCtx())
+		return err
+	case nodes.TRANS_STMT_COMMIT, nodes.TRANS_STMT_ROLLBACK:
+		tx := s.tx
+		if tx == nil {
+			// not in a transaction block
+			return nil
+		}
+
+		// the transaction block ends even if it fails to commit
+		s.tx = nil
+		if stmt.Kind == nodes.TRANS_STMT_COMMIT {
+			return tx.Commit(ctx)
+		}
+		return tx.Rollback(ctx)
+	case nodes.TRANS_STMT_SAVEPOINT:
+		if s.tx == nil {
+			return NoActiveSQLTransaction("SAVEPOINT can only be used in transaction blocks")
+		}
+		return s.tx.Savepoint(ctx, savepointName(stmt))
+	case nodes.TRANS_STMT_RELEASE:
+		if s.tx == nil {
+			return NoActiveSQLTransaction("RELEASE SAVEPOINT can only be used in transaction blocks")
+		}
+		return s.tx.Release(ctx, savepointName(stmt))
+	case nodes.TRANS_STMT_ROLLBACK_TO:
+		if s.tx == nil {
+			return NoActiveSQLTransaction("ROLLBACK TO SAVEPOINT can only be used in transaction blocks")
+		}
+		return s.tx.RollbackTo(ctx, savepointName(stmt))
+	default:
+		return Unsupported("two-phase commit")
+	}
+}
+
+// rollback rolls back the session's open transaction block, if any, as the
+// session ends
+func (s *session) rollback() {
+	if s.tx == nil {
+		return
+	}
+
+	// errors are ignored, there's no client left to report them to
+	s.tx.Rollback(context.Background())
+	s.tx = nil
+}
+
+// savepointName returns the name of the savepoint the statement refers to
+func savepointName(stmt nodes.TransactionStmt) string {
+	for _, n := range stmt.Options.Items {
+		opt, ok := n.(nodes.DefElem)
+		if !ok || opt.Defname == nil || *opt.Defname != "savepoint_name" {
+			continue
+		}
+
+		name, _ := opt.Arg.(nodes.String)
+		return name.Str
+	}
+	return ""
+}
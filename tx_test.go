@@ -0,0 +1,168 @@
+package pgsrv
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/jackc/pgx/pgproto3"
+	nodes "github.com/lfittl/pg_query_go/nodes"
+	"github.com/panoplyio/pgsrv/protocol"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// mockTransactor records the calls made to it and to its transactions
+type mockTransactor struct {
+	mockQueryer
+	calls []string
+	err   error
+}
+
+func (r *mockTransactor) Begin(ctx context.Context) (Tx, error) {
+	r.calls = append(r.calls, "begin")
+	return &mockTx{r, ctx}, nil
+}
+
+// mockTx is bound to the context it began with, like the transactions of
+// database/sql, which are rolled back once their contexts are done
+type mockTx struct {
+	transactor *mockTransactor
+	ctx        context.Context
+}
+
+func (tx *mockTx) call(name string) error {
+	tx.transactor.calls = append(tx.transactor.calls, name)
+	if tx.ctx.Err() != nil {
+		return fmt.Errorf("transaction has already been rolled back")
+	}
+	return tx.transactor.err
+}
+
+func (tx *mockTx) Query(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	err := tx.call("query")
+	if err != nil {
+		return nil, err
+	}
+	return &mockRows{}, nil
+}
+
+func (tx *mockTx) Describe(ctx context.Context, n nodes.Node) (driver.Rows, error) {
+	err := tx.call("describe")
+	if err != nil {
+		return nil, err
+	}
+	return &mockRows{}, nil
+}
+
+func (tx *mockTx) DescribeParameters(ctx context.Context, n nodes.Node) ([]string, error) {
+	return []string{"int8"}, tx.call("describe parameters")
+}
+
+func (tx *mockTx) Commit(ctx context.Context) error   { return tx.call("commit") }
+func (tx *mockTx) Rollback(ctx context.Context) error { return tx.call("rollback") }
+func (tx *mockTx) Savepoint(ctx context.Context, name string) error {
+	return tx.call("savepoint " + name)
+}
+func (tx *mockTx) RollbackTo(ctx context.Context, name string) error {
+	return tx.call("rollback to " + name)
+}
+func (tx *mockTx) Release(ctx context.Context, name string) error {
+	return tx.call("release " + name)
+}
+
+func TestSession_transact(t *testing.T) {
+	setup := func() (*session, *mockTransactor, *protocol.Transport, *pgproto3.Frontend) {
+		transactor := &mockTransactor{}
+		buf := &bytes.Buffer{}
+		frontend, _ := pgproto3.NewFrontend(buf, nil)
+		sess := &session{Server: &server{queryer: transactor}}
+		return sess, transactor, protocol.NewTransport(buf), frontend
+	}
+	run := func(t *testing.T, sess *session, transport *protocol.Transport, sql string) {
+		err := sess.newQuery(transport, sql).Run(sess)
+		require.NoError(t, err)
+	}
+
+	t.Run("routes queries through the transaction", func(t *testing.T) {
+		sess, transactor, transport, _ := setup()
+		run(t, sess, transport, "SELECT 1")
+		run(t, sess, transport, "BEGIN")
+		require.NotNil(t, sess.tx)
+		run(t, sess, transport, "SELECT 1")
+		run(t, sess, transport, "SAVEPOINT sp")
+		run(t, sess, transport, "ROLLBACK TO SAVEPOINT sp")
+		run(t, sess, transport, "RELEASE SAVEPOINT sp")
+		run(t, sess, transport, "COMMIT")
+		require.Nil(t, sess.tx)
+		require.Equal(t, protocol.TransactionIdle, transport.TransactionStatus())
+		require.Equal(t, []string{
+			"begin", "query", "savepoint sp", "rollback to sp", "release sp", "commit",
+		}, transactor.calls)
+	})
+	t.Run("describes through the transaction", func(t *testing.T) {
+		sess, transactor, transport, _ := setup()
+		sess.ConnInfo = newConnInfo()
+		sess.stmts = map[string]*nodes.PrepareStmt{}
+		sess.pendingStmts = map[string]*nodes.PrepareStmt{}
+		run(t, sess, transport, "BEGIN")
+
+		msgs, err := sess.prepare(transport, &pgproto3.Parse{Query: "SELECT $1"})
+		require.NoError(t, err)
+		require.False(t, msgs[0].IsError())
+		require.Equal(t, "int8", typeNameString(sess.pendingStmts[""].Argtypes.Items[0].(nodes.TypeName)))
+
+		msgs, err = sess.describe(transport, &pgproto3.Describe{ObjectType: protocol.DescribeStatement})
+		require.NoError(t, err)
+		require.Equal(t, byte('T'), msgs[1].Type())
+		require.Equal(t, []string{"begin", "describe parameters", "describe"}, transactor.calls)
+	})
+	t.Run("rolls back failed transactions", func(t *testing.T) {
+		sess, transactor, transport, _ := setup()
+		run(t, sess, transport, "BEGIN")
+		transactor.err = fmt.Errorf("failed")
+		run(t, sess, transport, "SAVEPOINT sp")
+		require.Equal(t, protocol.TransactionInFailedBlock, transport.TransactionStatus())
+
+		transactor.err = nil
+		run(t, sess, transport, "COMMIT")
+		require.Nil(t, sess.tx)
+		require.Equal(t, []string{"begin", "savepoint sp", "rollback"}, transactor.calls)
+	})
+	t.Run("rolls back when the session ends", func(t *testing.T) {
+		sess, transactor, transport, _ := setup()
+		run(t, sess, transport, "BEGIN")
+		sess.rollback()
+		require.Nil(t, sess.tx)
+		require.Equal(t, []string{"begin", "rollback"}, transactor.calls)
+	})
+	t.Run("outlives the statement timeout", func(t *testing.T) {
+		sess, transactor, transport, frontend := setup()
+		run(t, sess, transport, "SET statement_timeout = '10ms'")
+		run(t, sess, transport, "BEGIN")
+		time.Sleep(20 * time.Millisecond)
+		run(t, sess, transport, "SELECT 1")
+		run(t, sess, transport, "COMMIT")
+		require.Equal(t, []string{"begin", "query", "commit"}, transactor.calls)
+
+		for {
+			msg, err := frontend.Receive()
+			if err != nil {
+				break
+			}
+			_, failed := msg.(*pgproto3.ErrorResponse)
+			require.False(t, failed, "expected the transaction block to complete")
+		}
+	})
+	t.Run("fails on savepoints outside of transaction blocks", func(t *testing.T) {
+		sess, transactor, transport, frontend := setup()
+		run(t, sess, transport, "SAVEPOINT sp")
+		require.Empty(t, transactor.calls)
+
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+		require.Equal(t, "25P01", msg.(*pgproto3.ErrorResponse).Code)
+	})
+}
@@ -0,0 +1,295 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgtype"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OIDs of the built-in types that aren't named by pgtype
+const (
+	xmlOID      pgtype.OID = 142
+	intervalOID pgtype.OID = 1186
+	anyOID      pgtype.OID = 2276
+)
+
+// firstGeneratedOID is the first OID of the types registered by users, just
+// like FirstNormalObjectId of Postgres
+const firstGeneratedOID pgtype.OID = 16384
+
+// Type is a data type supported by the server, as described by pg_type
+type Type struct {
+	OID    pgtype.OID
+	Name   string
+	Len    int16      // size of the type, negative for variable-width types
+	Elem   pgtype.OID // element type of array types, zero otherwise
+	Array  pgtype.OID // array type of this type, zero if there's none
+	Base   pgtype.OID // base type of domains, zero otherwise
+	Labels []string   // labels of enums, in their sort order
+	Fields []Field    // attributes of composite types
+
+	value pgtype.Value // implements the encoding and decoding of values
+}
+
+// Field is an attribute of a composite type, of the named type
+type Field struct {
+	Name string
+	Type string
+}
+
+// Types is a registry of the data types supported by a server. It's
+// initialized with the built-in types and their arrays, and can be extended
+// with enums, domains and composite types, which are assigned generated OIDs.
+// Sessions use the types that are registered by the time they start.
+type Types struct {
+	mu      sync.RWMutex
+	byOID   map[pgtype.OID]*Type
+	byName  map[string]*Type
+	nextOID pgtype.OID
+}
+
+// builtinTypes are the built-in types, by their OID, name, size, array OID and
+// implementation. xml and any are treated as text.
+var builtinTypes = []struct {
+	oid   pgtype.OID
+	name  string
+	len   int16
+	array pgtype.OID
+	value pgtype.Value
+}{
+	{pgtype.BoolOID, "bool", 1, pgtype.BoolArrayOID, &pgtype.Bool{}},
+	{pgtype.ByteaOID, "bytea", -1, pgtype.ByteaArrayOID, &pgtype.Bytea{}},
+	{pgtype.CharOID, "char", 1, 1002, &pgtype.QChar{}},
+	{pgtype.NameOID, "name", 64, 1003, &pgtype.Name{}},
+	{pgtype.Int8OID, "int8", 8, pgtype.Int8ArrayOID, &pgtype.Int8{}},
+	{pgtype.Int2OID, "int2", 2, pgtype.Int2ArrayOID, &pgtype.Int2{}},
+	{pgtype.Int4OID, "int4", 4, pgtype.Int4ArrayOID, &pgtype.Int4{}},
+	{pgtype.TextOID, "text", -1, pgtype.TextArrayOID, &pgtype.Text{}},
+	{pgtype.OIDOID, "oid", 4, 1028, &pgtype.OIDValue{}},
+	{pgtype.JSONOID, "json", -1, 199, &pgtype.JSON{}},
+	{xmlOID, "xml", -1, 143, &pgtype.GenericText{}},
+	{pgtype.Float4OID, "float4", 4, pgtype.Float4ArrayOID, &pgtype.Float4{}},
+	{pgtype.Float8OID, "float8", 8, pgtype.Float8ArrayOID, &pgtype.Float8{}},
+	{pgtype.UnknownOID, "unknown", -2, 0, &pgtype.Unknown{}},
+	{moneyOID, "money", 8, 791, &pgMoney{}},
+	{pgtype.CIDROID, "cidr", -1, pgtype.CIDRArrayOID, &pgtype.CIDR{}},
+	{pgtype.InetOID, "inet", -1, pgtype.InetArrayOID, &pgtype.Inet{}},
+	{829, "macaddr", 6, 1040, &pgtype.Macaddr{}},
+	{pgtype.BPCharOID, "bpchar", -1, pgtype.BPCharArrayOID, &pgtype.BPChar{}},
+	{pgtype.VarcharOID, "varchar", -1, pgtype.VarcharArrayOID, &pgtype.Varchar{}},
+	{pgtype.DateOID, "date", 4, pgtype.DateArrayOID, &pgtype.Date{}},
+	{timeOID, "time", 8, 1183, &pgTime{}},
+	{pgtype.TimestampOID, "timestamp", 8, pgtype.TimestampArrayOID, &pgtype.Timestamp{}},
+	{pgtype.TimestamptzOID, "timestamptz", 8, pgtype.TimestamptzArrayOID, &pgtype.Timestamptz{}},
+	{intervalOID, "interval", 16, 1187, &pgtype.Interval{}},
+	{1560, "bit", -1, 1561, &pgtype.Bit{}},
+	{1562, "varbit", -1, 1563, &pgtype.Varbit{}},
+	{pgtype.NumericOID, "numeric", -1, 1231, &pgtype.Numeric{}},
+	{anyOID, "any", 4, 0, &pgtype.GenericText{}},
+	{pgtype.UUIDOID, "uuid", 16, pgtype.UUIDArrayOID, &pgtype.UUID{}},
+	{pgtype.JSONBOID, "jsonb", -1, 3807, &pgtype.JSONB{}},
+}
+
+// typeAliases maps the SQL names of the built-in types to their names
+var typeAliases = map[string]string{
+	"boolean":                     "bool",
+	"smallint":                    "int2",
+	"integer":                     "int4",
+	"int":                         "int4",
+	"bigint":                      "int8",
+	"real":                        "float4",
+	"double precision":            "float8",
+	"decimal":                     "numeric",
+	"character":                   "bpchar",
+	"character varying":           "varchar",
+	"bit varying":                 "varbit",
+	"time without time zone":      "time",
+	"timestamp without time zone": "timestamp",
+	"timestamp with time zone":    "timestamptz",
+
+	// misspelled name that backends described columns by in earlier versions
+	"timestampz": "timestamptz",
+}
+
+// NewTypes creates a registry of the built-in types
+func NewTypes() *Types {
+	t := &Types{
+		byOID:   map[pgtype.OID]*Type{},
+		byName:  map[string]*Type{},
+		nextOID: firstGeneratedOID,
+	}
+
+	for _, b := range builtinTypes {
+		t.add(&Type{OID: b.oid, Name: b.name, Len: b.len, Array: b.array, value: b.value})
+		if b.array != 0 {
+			t.addArray(t.byOID[b.oid], b.array)
+		}
+	}
+	return t
+}
+
+// ByOID looks up a type by its OID
+func (t *Types) ByOID(oid pgtype.OID) (*Type, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	typ, ok := t.byOID[oid]
+	return typ, ok
+}
+
+// ByName looks up a type by its name. Names are case insensitive, and may be
+// qualified by the pg_catalog schema. Arrays are named either by their element
+// type followed by [], or by the element type prefixed by an underscore.
+func (t *Types) ByName(name string) (*Type, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	typ, ok := t.byName[canonicalTypeName(name)]
+	return typ, ok
+}
+
+// RegisterEnum registers an enum type of the provided labels, along with its
+// array type
+func (t *Types) RegisterEnum(name string, labels ...string) (*Type, error) {
+	return t.register(&Type{
+		Name:   name,
+		Len:    4,
+		Labels: labels,
+		value:  &enumValue{labels: labels},
+	})
+}
+
+// RegisterDomain registers a domain over the named base type, along with its
+// array type. Values of domains are encoded as values of their base types.
+func (t *Types) RegisterDomain(name, base string) (*Type, error) {
+	baseType, ok := t.ByName(base)
+	if !ok {
+		return nil, UndefinedType(base)
+	}
+
+	return t.register(&Type{
+		Name:  name,
+		Len:   baseType.Len,
+		Base:  baseType.OID,
+		value: baseType.value,
+	})
+}
+
+// RegisterComposite registers a composite type of the provided fields, along
+// with its array type
+func (t *Types) RegisterComposite(name string, fields ...Field) (*Type, error) {
+	value := &compositeValue{
+		names:  make([]string, len(fields)),
+		oids:   make([]pgtype.OID, len(fields)),
+		fields: make([]pgtype.Value, len(fields)),
+	}
+	for i, f := range fields {
+		typ, ok := t.ByName(f.Type)
+		if !ok {
+			return nil, UndefinedType(f.Type)
+		}
+		value.names[i], value.oids[i], value.fields[i] = f.Name, typ.OID, typ.value
+	}
+
+	return t.register(&Type{
+		Name:   name,
+		Len:    -1,
+		Fields: fields,
+		value:  value,
+	})
+}
+
+// register adds a user defined type and its array type, with generated OIDs
+func (t *Types) register(typ *Type) (*Type, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	typ.Name = strings.ToLower(typ.Name)
+	if _, exists := t.byName[typ.Name]; exists {
+		return nil, DuplicateObject("type \"%s\" already exists", typ.Name)
+	}
+	if _, exists := t.byName["_"+typ.Name]; exists {
+		return nil, DuplicateObject("type \"_%s\" already exists", typ.Name)
+	}
+
+	typ.OID, typ.Array = t.nextOID, t.nextOID+1
+	t.nextOID += 2
+	t.add(typ)
+	t.addArray(typ, typ.Array)
+	return typ, nil
+}
+
+func (t *Types) add(typ *Type) {
+	t.byOID[typ.OID] = typ
+	t.byName[typ.Name] = typ
+}
+
+// addArray adds the array type of the provided element type
+func (t *Types) addArray(elem *Type, oid pgtype.OID) {
+	t.add(&Type{
+		OID:   oid,
+		Name:  "_" + elem.Name,
+		Len:   -1,
+		Elem:  elem.OID,
+		value: &arrayValue{elemOID: elem.OID, elem: elem.value},
+	})
+}
+
+// defaultTypes are the built-in types, used by sessions of servers that
+// weren't created by New
+var defaultTypes = NewTypes()
+
+// connInfo creates the pgtype registry of the types, which implements the
+// encoding and decoding of their values
+func (t *Types) connInfo() *pgtype.ConnInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	// built-in types are registered last, so that their implementations are
+	// mapped to them rather than to domains or user defined types
+	types := make([]*Type, 0, len(t.byOID))
+	for _, typ := range t.byOID {
+		types = append(types, typ)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].OID > types[j].OID })
+
+	ci := pgtype.NewConnInfo()
+	for _, typ := range types {
+		ci.RegisterDataType(pgtype.DataType{Value: typ.value, Name: typ.Name, OID: typ.OID})
+	}
+	return ci
+}
+
+// canonicalTypeName returns the name of the type as it's registered, for any
+// of its names, like INTEGER, pg_catalog.int4 or int4[]
+func canonicalTypeName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.TrimPrefix(name, "pg_catalog.")
+
+	array := false
+	if strings.HasSuffix(name, "[]") {
+		name, array = strings.TrimSpace(strings.TrimSuffix(name, "[]")), true
+	}
+
+	if alias, ok := typeAliases[name]; ok {
+		name = alias
+	}
+	if array {
+		name = "_" + name
+	}
+	return name
+}
+
+// newValue creates a fresh value of the data type, as the registered one is
+// shared by all of the sessions
+func newValue(dt *pgtype.DataType) pgtype.Value {
+	return cloneValue(dt.Value)
+}
+
+// cloneValue creates a copy of the value, which keeps its configuration, like
+// the labels of enums or the element type of arrays
+func cloneValue(v pgtype.Value) pgtype.Value {
+	clone := reflect.New(reflect.ValueOf(v).Elem().Type())
+	clone.Elem().Set(reflect.ValueOf(v).Elem())
+	return clone.Interface().(pgtype.Value)
+}
@@ -0,0 +1,132 @@
+package pgsrv
+
+import (
+	"github.com/jackc/pgx/pgtype"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestTypes_ByName(t *testing.T) {
+	types := NewTypes()
+	for name, oid := range map[string]pgtype.OID{
+		"int4":                     pgtype.Int4OID,
+		"INT4":                     pgtype.Int4OID,
+		"pg_catalog.int4":          pgtype.Int4OID,
+		"integer":                  pgtype.Int4OID,
+		"timestamp with time zone": pgtype.TimestamptzOID,
+		"TIMESTAMPZ":               pgtype.TimestamptzOID,
+		"_int4":                    pgtype.Int4ArrayOID,
+		"int4[]":                   pgtype.Int4ArrayOID,
+		"INTERVAL[]":               1187,
+		"uuid":                     pgtype.UUIDOID,
+		"inet":                     pgtype.InetOID,
+		"bit":                      1560,
+		"money":                    moneyOID,
+	} {
+		typ, ok := types.ByName(name)
+		require.True(t, ok, name)
+		require.Equal(t, oid, typ.OID, name)
+	}
+
+	_, ok := types.ByName("timestamp with timezone")
+	require.False(t, ok)
+}
+
+func TestTypes_ByOID(t *testing.T) {
+	types := NewTypes()
+	typ, ok := types.ByOID(pgtype.Int4ArrayOID)
+	require.True(t, ok)
+	require.Equal(t, "_int4", typ.Name)
+	require.Equal(t, pgtype.OID(pgtype.Int4OID), typ.Elem)
+	require.Equal(t, int16(-1), typ.Len)
+
+	typ, ok = types.ByOID(pgtype.Int4OID)
+	require.True(t, ok)
+	require.Equal(t, pgtype.OID(pgtype.Int4ArrayOID), typ.Array)
+	require.Equal(t, int16(4), typ.Len)
+}
+
+func TestTypes_Register(t *testing.T) {
+	types := NewTypes()
+
+	t.Run("enum", func(t *testing.T) {
+		typ, err := types.RegisterEnum("Mood", "sad", "ok", "happy")
+		require.NoError(t, err)
+		require.Equal(t, firstGeneratedOID, typ.OID)
+		require.Equal(t, firstGeneratedOID+1, typ.Array)
+		require.Equal(t, "mood", typ.Name)
+
+		arr, ok := types.ByName("mood[]")
+		require.True(t, ok)
+		require.Equal(t, typ.OID, arr.Elem)
+
+		ci := types.connInfo()
+		buf, err := encodeText(ci, typ.OID, "happy")
+		require.NoError(t, err)
+		require.Equal(t, "happy", string(buf))
+
+		buf, err = encodeText(ci, typ.Array, []string{"sad", "ok"})
+		require.NoError(t, err)
+		require.Equal(t, "{sad,ok}", string(buf))
+
+		_, err = encodeBinary(ci, typ.OID, "angry")
+		require.Error(t, err)
+	})
+	t.Run("domain", func(t *testing.T) {
+		typ, err := types.RegisterDomain("posint", "integer")
+		require.NoError(t, err)
+		require.Equal(t, firstGeneratedOID+2, typ.OID)
+		require.Equal(t, pgtype.OID(pgtype.Int4OID), typ.Base)
+		require.Equal(t, int16(4), typ.Len)
+
+		buf, err := encodeBinary(types.connInfo(), typ.OID, int64(1))
+		require.NoError(t, err)
+		require.Equal(t, []byte{0, 0, 0, 1}, buf)
+	})
+	t.Run("composite", func(t *testing.T) {
+		typ, err := types.RegisterComposite("pair", Field{"a", "int4"}, Field{"b", "text"})
+		require.NoError(t, err)
+		require.Equal(t, firstGeneratedOID+4, typ.OID)
+
+		buf, err := encodeText(types.connInfo(), typ.OID, []interface{}{int64(1), "a b"})
+		require.NoError(t, err)
+		require.Equal(t, `(1,"a b")`, string(buf))
+	})
+	t.Run("fails on duplicate types", func(t *testing.T) {
+		_, err := types.RegisterEnum("int4")
+		require.Error(t, err)
+		require.Equal(t, "42710", fromErr(err).Code())
+		require.Equal(t, "type \"int4\" already exists", err.Error())
+	})
+	t.Run("fails on undefined types", func(t *testing.T) {
+		_, err := types.RegisterDomain("d", "foo")
+		require.Error(t, err)
+		require.Equal(t, "42704", fromErr(err).Code())
+
+		_, err = types.RegisterComposite("c", Field{"a", "foo"})
+		require.Error(t, err)
+		require.Equal(t, "42704", fromErr(err).Code())
+	})
+}
+
+func TestQuery_columns_domain(t *testing.T) {
+	types := NewTypes()
+	_, err := types.RegisterDomain("int4", "text")
+	require.Error(t, err, "expected built-in names to be reserved")
+
+	_, err = types.RegisterDomain("code", "varchar")
+	require.NoError(t, err)
+
+	sess := &session{Server: &server{queryer: &mockQueryer{}, types: types}}
+	q := sess.newQuery(nil, "")
+	cols, err := q.columns(&mockDomainRows{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint32(pgtype.VarcharOID), cols[0].TypeOid, "expected domains to be described as their base types")
+}
+
+// mockDomainRows returns a column of the code domain
+type mockDomainRows struct {
+	mockRows
+}
+
+func (r *mockDomainRows) ColumnTypeDatabaseTypeName(index int) string { return "code" }